@@ -31,14 +31,14 @@ func run(port int) error {
 		return err
 	}
 
-	data, err := quikService.IsConnected()
+	data, err := quikService.IsConnected(ctx)
 	if err != nil {
 		return err
 	}
 	res, _ := quikservice.ParseInt(data.Data)
 	fmt.Println(res == 1)
 
-	data, err = quikService.MessageInfo("Где деньги, Лебовски?")
+	data, err = quikService.MessageInfo(ctx, "Где деньги, Лебовски?")
 	if err != nil {
 		return err
 	}
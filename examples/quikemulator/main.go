@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/connectors/quikemulator"
+	"github.com/ChizhovVadim/trader/pkg/connectors/quikservice"
+)
+
+// Эмулятор QUIK для запуска examples/robot и examples/helloquik без терминала.
+// На все подписки раз в period отправляет последний закрытый бар случайного блуждания,
+// как QuikSharp. Повторы одного бара QuikBroker отбрасывает.
+func main() {
+	var port int = 34132
+	var period = 5 * time.Second
+	flag.IntVar(&port, "port", port, "")
+	flag.DurationVar(&period, "period", period, "")
+	flag.Parse()
+
+	var err = run(port, period)
+	if err != nil {
+		log.Println("app failed", "error", err)
+	}
+}
+
+func run(port int, period time.Duration) error {
+	var ctx, cancel = signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	var server = quikemulator.New(log.Default())
+	server.SetPortfolio("", "test", map[string]any{
+		"start_limit_open_pos": 1_000_000,
+	})
+	if err := server.Start(port); err != nil {
+		return err
+	}
+	defer server.Close()
+	log.Println("quik emulator started", "port", server.Port())
+
+	var prices = make(map[string]float64)
+	var ticker = time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		for _, subscription := range server.Subscriptions() {
+			var candle, ok = nextCandle(subscription, prices)
+			if !ok {
+				continue
+			}
+			if err := server.PushCandle(candle); err != nil {
+				log.Println("PushCandle", "error", err)
+			}
+		}
+	}
+}
+
+func nextCandle(subscription string, prices map[string]float64) (quikservice.Candle, bool) {
+	var args = strings.Split(subscription, "|")
+	if len(args) != 3 {
+		return quikservice.Candle{}, false
+	}
+	interval, err := strconv.Atoi(args[2])
+	if err != nil {
+		return quikservice.Candle{}, false
+	}
+	var open, found = prices[subscription]
+	if !found {
+		open = 100_000
+	}
+	var close = open * (1 + 0.001*rand.NormFloat64())
+	prices[subscription] = close
+	var barDuration = time.Duration(max(1, interval)) * time.Minute
+	var barStart = time.Now().Truncate(barDuration).Add(-barDuration)
+	return quikservice.Candle{
+		Open:      open,
+		High:      max(open, close),
+		Low:       min(open, close),
+		Close:     close,
+		Volume:    1,
+		ClassCode: args[0],
+		SecCode:   args[1],
+		Interval:  interval,
+		Datetime: quikservice.QuikDateTime{
+			Min:   barStart.Minute(),
+			Hour:  barStart.Hour(),
+			Day:   barStart.Day(),
+			Month: int(barStart.Month()),
+			Year:  barStart.Year(),
+		},
+	}, true
+}
@@ -1,15 +1,41 @@
 package main
 
-import "time"
+import (
+	"fmt"
 
-// TODO
-type AdvisorSample struct {
-}
+	"github.com/ChizhovVadim/trader/pkg/indicators"
+	"github.com/ChizhovVadim/trader/pkg/strategies"
+)
 
-func (a *AdvisorSample) Add(d time.Time, price float64) bool {
-	return true
+func init() {
+	strategies.RegisterAdvisor(strategies.AdvisorFactory{
+		Name: "sample",
+		Params: []strategies.AdvisorParam{
+			{Name: "momentum", Type: strategies.ParamInt, Default: "48", Description: "период моментума в барах"},
+			{Name: "channel", Type: strategies.ParamInt, Default: "96", Description: "период канала Дончиана в барах"},
+			{Name: "weight", Type: strategies.ParamFloat, Default: "0.5", Description: "вес моментума, остальное - вес пробоя"},
+		},
+		New: newAdvisorSample,
+	})
 }
 
-func (a *AdvisorSample) Value() float64 {
-	return 0
+// Пример советника из готовых индикаторов: тренд по моментуму и пробою канала.
+func newAdvisorSample(params strategies.AdvisorParams) (strategies.Indicator, error) {
+	var weight = params.Float("weight")
+	for _, name := range []string{"momentum", "channel"} {
+		if params.Int(name) <= 0 {
+			return nil, fmt.Errorf("param %v must be positive", name)
+		}
+	}
+	momentum, err := indicators.NewMomentum(params.Int("momentum"), 2*params.Int("momentum"))
+	if err != nil {
+		return nil, err
+	}
+	channel, err := indicators.NewDonchian(params.Int("channel"))
+	if err != nil {
+		return nil, err
+	}
+	return indicators.NewClamp(indicators.NewWeightedSum().
+		With(momentum, weight).
+		With(channel, 1-weight)), nil
 }
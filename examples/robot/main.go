@@ -5,9 +5,7 @@ import (
 	"log/slog"
 	"os"
 
-	"github.com/ChizhovVadim/trader/pkg/brokers"
-	"github.com/ChizhovVadim/trader/pkg/brokers/quik"
-	"github.com/ChizhovVadim/trader/pkg/moex"
+	"github.com/ChizhovVadim/trader/pkg/config"
 	"github.com/ChizhovVadim/trader/pkg/strategies"
 )
 
@@ -25,31 +23,19 @@ func main() {
 }
 
 func robotHandler(logger *slog.Logger) error {
-	var trader = strategies.NewTrader(logger)
-	defer trader.Close()
-	var err = configureTrader(logger, trader)
+	var configPath = "robot.xml"
+	if len(os.Args) > 1 {
+		configPath = os.Args[1]
+	}
+	robot, err := config.Load(configPath)
 	if err != nil {
 		return err
 	}
-	return trader.Run(context.Background())
-}
-
-func configureTrader(logger *slog.Logger, trader *strategies.Trader) error {
-	trader.Broker.Add("paper", brokers.NewMockBroker(logger, "paper"))         // Для сделок
-	var marketData = quik.NewQuikBroker(logger, "quik", 34132, trader.Inbox()) // Для получения баров
-	trader.Broker.Add("quik", marketData)
-
-	var security, err = moex.GetSecurityInfo("Si-12.25")
+	var trader = strategies.NewTrader(logger)
+	defer trader.Close()
+	err = config.Build(logger, trader, robot)
 	if err != nil {
 		return err
 	}
-	trader.AddSignal(strategies.NewSignalService(logger, "signal", marketData, security, "minutes5",
-		&AdvisorSample{}, strategies.SizeConfig{MaxLever: 5, LongLever: 5, ShortLever: 5, Weight: 1}))
-
-	trader.AddPortfolio(strategies.NewPortfolioService(logger, trader.Broker,
-		&strategies.Portfolio{Portfolio: brokers.Portfolio{Client: "paper", Portfolio: "test"}},
-		0, 0))
-
-	trader.AddStrategiesForAllSignalPortfolioPairs()
-	return nil
+	return trader.Run(context.Background())
 }
@@ -0,0 +1,112 @@
+package brokers
+
+import "sync"
+
+// Доставляет сообщения в callbacks в порядке Publish, не блокируя отправителя.
+// Нужна, когда сообщения создаются в том же event loop, который читает callbacks.
+// Сообщения отправляет одна горутина, которая завершается в Close.
+// Без callbacks сообщения отбрасываются, чтобы очередь не росла без потребителя.
+type CallbackQueue struct {
+	callbacks chan<- any
+	mu        sync.Mutex
+	msgs      []any
+	started   bool
+	closed    bool
+	wake      chan struct{}
+	done      chan struct{}
+	// сообщения копятся до Drain
+	buffered bool
+}
+
+func NewCallbackQueue(callbacks chan<- any) *CallbackQueue {
+	return &CallbackQueue{
+		callbacks: callbacks,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// Очередь без канала: сообщения копятся до Drain, например, в тестировании на истории.
+func NewCallbackBuffer() *CallbackQueue {
+	return &CallbackQueue{
+		buffered: true,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (q *CallbackQueue) Publish(msgs ...any) {
+	if q == nil || len(msgs) == 0 {
+		return
+	}
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	if q.callbacks == nil {
+		if q.buffered {
+			q.msgs = append(q.msgs, msgs...)
+		}
+		q.mu.Unlock()
+		return
+	}
+	q.msgs = append(q.msgs, msgs...)
+	if !q.started {
+		q.started = true
+		go q.run()
+	}
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *CallbackQueue) run() {
+	for {
+		q.mu.Lock()
+		var msgs = q.msgs
+		q.msgs = nil
+		q.mu.Unlock()
+		for _, msg := range msgs {
+			select {
+			case <-q.done:
+				return
+			case q.callbacks <- msg:
+			}
+		}
+		select {
+		case <-q.done:
+			return
+		case <-q.wake:
+		}
+	}
+}
+
+// Сообщения, накопленные NewCallbackBuffer, в порядке Publish.
+func (q *CallbackQueue) Drain() []any {
+	if q == nil || !q.buffered {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var msgs = q.msgs
+	q.msgs = nil
+	return msgs
+}
+
+// Недоставленные сообщения отбрасываются.
+func (q *CallbackQueue) Close() error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		q.msgs = nil
+		close(q.done)
+	}
+	return nil
+}
@@ -16,7 +16,7 @@ type HistoryCandle struct {
 }
 
 type Candle struct {
-	Interval     string
+	Interval     Timeframe
 	SecurityCode string
 	HistoryCandle
 }
@@ -52,6 +52,82 @@ type Order struct {
 	Price     float64 //or string?
 }
 
+type OrderStatus int
+
+const (
+	// Заявка зарегистрирована, но еще не исполнена
+	OrderStatusNew OrderStatus = iota
+	OrderStatusPartiallyFilled
+	OrderStatusFilled
+	OrderStatusCancelled
+	// Заявка отвергнута брокером или биржей
+	OrderStatusRejected
+)
+
+func (s OrderStatus) String() string {
+	switch s {
+	case OrderStatusNew:
+		return "new"
+	case OrderStatusPartiallyFilled:
+		return "partiallyfilled"
+	case OrderStatusFilled:
+		return "filled"
+	case OrderStatusCancelled:
+		return "cancelled"
+	case OrderStatusRejected:
+		return "rejected"
+	default:
+		return "unknown"
+	}
+}
+
+// Состояние заявки. Брокер отправляет его в callbacks при каждом изменении.
+type OrderState struct {
+	Id     string
+	Order  Order
+	Status OrderStatus
+	// Исполненный объем, знак как у Order.Volume
+	FilledVolume int
+	// Причина отклонения
+	Reason string
+}
+
+// Заявка больше не может измениться
+func (s OrderState) IsFinal() bool {
+	return s.Status == OrderStatusFilled ||
+		s.Status == OrderStatusCancelled ||
+		s.Status == OrderStatusRejected
+}
+
+// Пропуск в потоке баров подписки, например, после потери связи.
+type CandleGap struct {
+	Interval     Timeframe
+	SecurityCode string
+	// Последний полученный бар
+	From time.Time
+	// Первый бар после пропуска
+	To time.Time
+	// Сколько баров должно было начаться в торговое время
+	Missed int
+}
+
+// Сделка по заявке
+type Trade struct {
+	OrderId      string
+	Portfolio    Portfolio
+	SecurityCode string
+	DateTime     time.Time
+	// Знак как у Order.Volume
+	Volume int
+	Price  float64
+}
+
+// Изменение состояния подключения брокера
+type ConnectionState struct {
+	Client    string
+	Connected bool
+}
+
 type PortfolioLimits struct {
 	// Лимит открытых позиций на начало дня
 	StartLimitOpenPos float64
@@ -64,16 +140,25 @@ type PortfolioLimits struct {
 }
 
 type IMarketData interface {
-	GetLastCandles(security Security, timeframe string) iter.Seq2[HistoryCandle, error]
-	SubscribeCandles(security Security, timeframe string) error
+	GetLastCandles(security Security, timeframe Timeframe) iter.Seq2[HistoryCandle, error]
+	SubscribeCandles(security Security, timeframe Timeframe) error
+	UnsubscribeCandles(security Security, timeframe Timeframe) error
 	//LastPrice(security Security) (float64, error)
 }
 
+// Получатель баров из inbox, например, для моделирования исполнения заявок
+type ICandleHandler interface {
+	OnCandle(candle Candle)
+}
+
 type IBroker interface {
 	Init(context.Context) error
 	CheckStatus()
 	Close() error
 	GetPortfolioLimits(portfolio Portfolio) (PortfolioLimits, error)
 	GetPosition(portfolio Portfolio, security Security) (float64, error)
-	RegisterOrder(order Order) error
+	// Возвращает идентификатор заявки. Изменения состояния заявки приходят как OrderState.
+	RegisterOrder(order Order) (string, error)
+	CancelOrder(portfolio Portfolio, orderId string) error
+	GetOrder(portfolio Portfolio, orderId string) (OrderState, error)
 }
@@ -5,72 +5,378 @@ import (
 	"fmt"
 	"iter"
 	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"time"
 )
 
 var _ IBroker = (*MockBroker)(nil)
 var _ IMarketData = (*MockBroker)(nil)
+var _ ICandleHandler = (*MockBroker)(nil)
 
+type MockBrokerConfig struct {
+	// Лимит открытых позиций нового портфеля
+	StartAmount float64
+	// Биржевой сбор за контракт
+	ExchangeFee float64
+	// Комиссия брокера за контракт
+	BrokerFee float64
+	// Гарантийное обеспечение как доля стоимости контракта
+	MarginRatio float64
+	// Таймфрейм баров, по которым исполняются заявки.
+	// Пустой - самый младший из полученных по инструменту.
+	FillTimeframe Timeframe
+}
+
+// Клиринги FORTS от начала дня по времени баров (московскому).
+// На промежуточном вариационная маржа фиксируется, на основном переходит в лимит.
+var (
+	intermediateClearing = 14 * time.Hour
+	mainClearing         = 18*time.Hour + 50*time.Minute
+)
+
+// Брокер для бумажной торговли.
+// Лимитные заявки исполняются по барам из OnCandle, только если цена коснулась цены заявки.
 type MockBroker struct {
-	logger    *slog.Logger
-	name      string
-	positions map[string]float64
+	logger     *slog.Logger
+	name       string
+	config     MockBrokerConfig
+	callbacks  *CallbackQueue
+	mu         sync.Mutex
+	portfolios map[string]*mockPortfolio
+	orders     map[string]*mockOrder
+	lastPrices map[string]float64
+	// младший таймфрейм по инструменту
+	fillTimeframes map[string]Timeframe
+	lastTime       time.Time
+	orderId        int
 }
 
-func NewMockBroker(logger *slog.Logger, name string) *MockBroker {
+type mockOrder struct {
+	OrderState
+	// день регистрации по времени баров
+	date time.Time
+}
+
+type mockPortfolio struct {
+	// Лимит открытых позиций на начало дня
+	startLimit float64
+	// Вариационная маржа по закрытым позициям и комиссии за день
+	accVarMargin float64
+	positions    map[string]*mockPosition
+}
+
+type mockPosition struct {
+	security Security
+	volume   int
+	// Цена последнего клиринга или сделки
+	settlePrice float64
+}
+
+func NewMockBroker(
+	logger *slog.Logger,
+	name string,
+	config MockBrokerConfig,
+	callbacks chan<- any,
+) *MockBroker {
 	logger = logger.With(
 		"client", name,
 		"type", "mock")
 	return &MockBroker{
-		logger:    logger,
-		name:      name,
-		positions: make(map[string]float64),
+		logger:         logger,
+		name:           name,
+		config:         config,
+		callbacks:      NewCallbackQueue(callbacks),
+		portfolios:     make(map[string]*mockPortfolio),
+		orders:         make(map[string]*mockOrder),
+		lastPrices:     make(map[string]float64),
+		fillTimeframes: make(map[string]Timeframe),
 	}
 }
 
+// Брокер без канала callbacks: сообщения копятся до Drain, например, в тестировании на истории.
+func NewBufferedMockBroker(
+	logger *slog.Logger,
+	name string,
+	config MockBrokerConfig,
+) *MockBroker {
+	var b = NewMockBroker(logger, name, config, nil)
+	b.callbacks = NewCallbackBuffer()
+	return b
+}
+
 func (b *MockBroker) Init(context.Context) error {
 	b.logger.Info("Init broker")
 	return nil
 }
 
 func (b *MockBroker) CheckStatus() {
-	fmt.Printf("%10s %10s\n", b.name, "mock")
+	b.mu.Lock()
+	var activeOrders int
+	for _, order := range b.orders {
+		if !order.IsFinal() {
+			activeOrders += 1
+		}
+	}
+	b.mu.Unlock()
+	fmt.Printf("%10s %10s active orders: %v\n", b.name, "mock", activeOrders)
 }
 
 func (b *MockBroker) GetPortfolioLimits(portfolio Portfolio) (PortfolioLimits, error) {
-	return PortfolioLimits{
-		StartLimitOpenPos: 1_000_000,
-	}, nil
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var p = b.getPortfolio(portfolio)
+	var limits = PortfolioLimits{
+		StartLimitOpenPos: p.startLimit,
+		AccVarMargin:      p.accVarMargin,
+	}
+	for _, position := range p.positions {
+		var lastPrice = b.lastPrice(position)
+		limits.VarMargin += float64(position.volume) * (lastPrice - position.settlePrice) * position.security.Lever
+		limits.UsedLimOpenPos += b.margin(position.security, position.volume, lastPrice)
+	}
+	for _, order := range b.orders {
+		if !order.IsFinal() && order.Order.Portfolio == portfolio {
+			limits.UsedLimOpenPos += b.margin(order.Order.Security, order.Order.Volume-order.FilledVolume, order.Order.Price)
+		}
+	}
+	return limits, nil
 }
 
 func (b *MockBroker) GetPosition(portfolio Portfolio, security Security) (float64, error) {
-	return b.positions[b.positionKey(portfolio, security)], nil
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var position, found = b.getPortfolio(portfolio).positions[security.Code]
+	if !found {
+		return 0, nil
+	}
+	return float64(position.volume), nil
 }
 
-func (b *MockBroker) RegisterOrder(order Order) error {
+func (b *MockBroker) RegisterOrder(order Order) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.orderId += 1
+	var orderId = strconv.Itoa(b.orderId)
 	b.logger.Info("RegisterOrder",
 		"portfolio", order.Portfolio.Portfolio,
 		"security", order.Security.Name,
 		"volume", order.Volume,
-		"price", order.Price)
-	b.positions[b.positionKey(order.Portfolio, order.Security)] += float64(order.Volume)
-	return nil
+		"price", order.Price,
+		"orderId", orderId)
+	var y, m, d = b.lastTime.Date()
+	var today = time.Date(y, m, d, 0, 0, 0, 0, b.lastTime.Location())
+	b.evictOrders(today)
+	b.orders[orderId] = &mockOrder{
+		OrderState: OrderState{
+			Id:     orderId,
+			Order:  order,
+			Status: OrderStatusNew,
+		},
+		date: today,
+	}
+	return orderId, nil
 }
 
-func (b *MockBroker) Close() error {
+// Завершенные заявки прошлых дней больше не нужны,
+// иначе OnCandle и GetPortfolioLimits перебирают все заявки за историю.
+func (b *MockBroker) evictOrders(today time.Time) {
+	for orderId, order := range b.orders {
+		if order.IsFinal() && order.date.Before(today) {
+			delete(b.orders, orderId)
+		}
+	}
+}
+
+func (b *MockBroker) CancelOrder(portfolio Portfolio, orderId string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var order, found = b.orders[orderId]
+	if !found {
+		return fmt.Errorf("order not found %v", orderId)
+	}
+	if order.IsFinal() {
+		return fmt.Errorf("order is not active %v", orderId)
+	}
+	b.logger.Info("CancelOrder",
+		"portfolio", portfolio.Portfolio,
+		"orderId", orderId)
+	order.Status = OrderStatusCancelled
+	b.callbacks.Publish(order.OrderState)
 	return nil
 }
 
-func (b *MockBroker) positionKey(portfolio Portfolio, security Security) string {
-	return portfolio.Portfolio + security.Code
+func (b *MockBroker) GetOrder(portfolio Portfolio, orderId string) (OrderState, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var order, found = b.orders[orderId]
+	if !found {
+		return OrderState{}, fmt.Errorf("order not found %v", orderId)
+	}
+	return order.OrderState, nil
+}
+
+// Исполняет активные заявки, если бар коснулся цены заявки.
+// Бары старших таймфреймов начинаются раньше заявки, поэтому заявки исполняются только по младшему.
+func (b *MockBroker) OnCandle(candle Candle) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.isFillCandle(candle) {
+		return
+	}
+	if candle.DateTime.After(b.lastTime) {
+		if !b.lastTime.IsZero() {
+			b.clearings(b.lastTime, candle.DateTime)
+		}
+		b.lastTime = candle.DateTime
+	}
+	b.lastPrices[candle.SecurityCode] = candle.ClosePrice
+	for _, order := range b.orders {
+		if order.IsFinal() ||
+			order.Order.Security.Code != candle.SecurityCode {
+			continue
+		}
+		var price, ok = fillPrice(order.Order, candle)
+		if !ok {
+			continue
+		}
+		b.fill(order, price, candle.DateTime)
+	}
+}
+
+func (b *MockBroker) isFillCandle(candle Candle) bool {
+	if b.config.FillTimeframe != "" {
+		return candle.Interval == b.config.FillTimeframe
+	}
+	var timeframe, found = b.fillTimeframes[candle.SecurityCode]
+	if !found || candle.Interval.order() < timeframe.order() {
+		b.fillTimeframes[candle.SecurityCode] = candle.Interval
+		return true
+	}
+	return candle.Interval == timeframe
+}
+
+// Клиринги между барами (from, to]. Время бара - время его открытия,
+// поэтому бар 14:05 открывается уже после промежуточного клиринга.
+func (b *MockBroker) clearings(from, to time.Time) {
+	var y, m, d = from.Date()
+	for day := time.Date(y, m, d, 0, 0, 0, 0, from.Location()); !day.After(to); day = day.AddDate(0, 0, 1) {
+		for _, clearing := range []time.Duration{intermediateClearing, mainClearing} {
+			var t = day.Add(clearing)
+			if t.After(from) && !t.After(to) {
+				b.clearing(clearing == mainClearing)
+			}
+		}
+	}
 }
 
-func (b *MockBroker) GetLastCandles(security Security, timeframe string) iter.Seq2[HistoryCandle, error] {
+func fillPrice(order Order, candle Candle) (float64, bool) {
+	if order.Volume > 0 {
+		if candle.LowPrice > order.Price {
+			return 0, false
+		}
+		return min(order.Price, candle.OpenPrice), true
+	} else {
+		if candle.HighPrice < order.Price {
+			return 0, false
+		}
+		return max(order.Price, candle.OpenPrice), true
+	}
+}
+
+func (b *MockBroker) fill(order *mockOrder, price float64, dateTime time.Time) {
+	var volume = order.Order.Volume - order.FilledVolume
+	var p = b.getPortfolio(order.Order.Portfolio)
+	var position, found = p.positions[order.Order.Security.Code]
+	if !found {
+		position = &mockPosition{security: order.Order.Security, settlePrice: price}
+		p.positions[order.Order.Security.Code] = position
+	}
+	// переоцениваем позицию по цене сделки
+	p.accVarMargin += float64(position.volume) * (price - position.settlePrice) * position.security.Lever
+	position.settlePrice = price
+	position.volume += volume
+	p.accVarMargin -= (b.config.ExchangeFee + b.config.BrokerFee) * math.Abs(float64(volume))
+
+	order.FilledVolume = order.Order.Volume
+	order.Status = OrderStatusFilled
+	b.logger.Info("Order filled",
+		"portfolio", order.Order.Portfolio.Portfolio,
+		"security", order.Order.Security.Name,
+		"volume", volume,
+		"price", price,
+		"orderId", order.Id)
+	b.callbacks.Publish(order.OrderState, Trade{
+		OrderId:      order.Id,
+		Portfolio:    order.Order.Portfolio,
+		SecurityCode: order.Order.Security.Code,
+		DateTime:     dateTime,
+		Volume:       volume,
+		Price:        price,
+	})
+}
+
+func (b *MockBroker) clearing(main bool) {
+	for _, p := range b.portfolios {
+		for _, position := range p.positions {
+			var lastPrice = b.lastPrice(position)
+			p.accVarMargin += float64(position.volume) * (lastPrice - position.settlePrice) * position.security.Lever
+			position.settlePrice = lastPrice
+		}
+		if main {
+			p.startLimit += p.accVarMargin
+			p.accVarMargin = 0
+		}
+	}
+}
+
+func (b *MockBroker) getPortfolio(portfolio Portfolio) *mockPortfolio {
+	var p, found = b.portfolios[portfolio.Portfolio]
+	if !found {
+		p = &mockPortfolio{
+			startLimit: b.config.StartAmount,
+			positions:  make(map[string]*mockPosition),
+		}
+		b.portfolios[portfolio.Portfolio] = p
+	}
+	return p
+}
+
+func (b *MockBroker) lastPrice(position *mockPosition) float64 {
+	if price, found := b.lastPrices[position.security.Code]; found {
+		return price
+	}
+	return position.settlePrice
+}
+
+func (b *MockBroker) margin(security Security, volume int, price float64) float64 {
+	return math.Abs(float64(volume)) * price * security.Lever * b.config.MarginRatio
+}
+
+// Состояния заявок и сделки брокера, созданного NewBufferedMockBroker.
+func (b *MockBroker) Drain() []any {
+	return b.callbacks.Drain()
+}
+
+func (b *MockBroker) Close() error {
+	return b.callbacks.Close()
+}
+
+func (b *MockBroker) GetLastCandles(security Security, timeframe Timeframe) iter.Seq2[HistoryCandle, error] {
 	return func(yield func(HistoryCandle, error) bool) {}
 }
 
-func (b *MockBroker) SubscribeCandles(security Security, timeframe string) error {
+func (b *MockBroker) SubscribeCandles(security Security, timeframe Timeframe) error {
 	b.logger.Debug("SubscribeCandles",
 		"security", security.Code,
 		"timeframe", timeframe)
 	return nil
 }
+
+func (b *MockBroker) UnsubscribeCandles(security Security, timeframe Timeframe) error {
+	b.logger.Debug("UnsubscribeCandles",
+		"security", security.Code,
+		"timeframe", timeframe)
+	return nil
+}
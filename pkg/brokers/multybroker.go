@@ -54,10 +54,18 @@ func (b *MultyBroker) GetPosition(portfolio Portfolio, security Security) (float
 	return b.brokers[portfolio.Client].GetPosition(portfolio, security)
 }
 
-func (b *MultyBroker) RegisterOrder(order Order) error {
+func (b *MultyBroker) RegisterOrder(order Order) (string, error) {
 	return b.brokers[order.Portfolio.Client].RegisterOrder(order)
 }
 
+func (b *MultyBroker) CancelOrder(portfolio Portfolio, orderId string) error {
+	return b.brokers[portfolio.Client].CancelOrder(portfolio, orderId)
+}
+
+func (b *MultyBroker) GetOrder(portfolio Portfolio, orderId string) (OrderState, error) {
+	return b.brokers[portfolio.Client].GetOrder(portfolio, orderId)
+}
+
 func (b *MultyBroker) Close() error {
 	for _, broker := range b.brokers {
 		broker.Close()
@@ -0,0 +1,128 @@
+package quik
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+	"github.com/ChizhovVadim/trader/pkg/moex"
+)
+
+type candleStatus int
+
+const (
+	// Закрытый бар новее последнего
+	candleClosed candleStatus = iota
+	// Бар еще формируется, закрытый придет позже с тем же временем
+	candleInProgress
+	candleDuplicate
+	candleOutOfOrder
+	// После подписки QUIK может повторить старые бары
+	candleStale
+)
+
+func (s candleStatus) String() string {
+	switch s {
+	case candleClosed:
+		return "closed"
+	case candleInProgress:
+		return "inprogress"
+	case candleDuplicate:
+		return "duplicate"
+	case candleOutOfOrder:
+		return "outoforder"
+	case candleStale:
+		return "stale"
+	default:
+		return "unknown"
+	}
+}
+
+// Пропускает только новые закрытые бары подписок и находит пропуски в потоке.
+type candleFilter struct {
+	mu sync.Mutex
+	// время последнего закрытого бара
+	last map[candleKey]time.Time
+}
+
+type candleKey struct {
+	securityCode string
+	interval     brokers.Timeframe
+}
+
+func newCandleFilter() *candleFilter {
+	return &candleFilter{
+		last: make(map[candleKey]time.Time),
+	}
+}
+
+func (f *candleFilter) check(
+	candle brokers.Candle,
+	market moex.Market,
+	now time.Time,
+) (candleStatus, brokers.CandleGap, bool) {
+	var duration = candle.Interval.Duration()
+	if duration == 0 {
+		// тики и месяцы не проверяем
+		return candleClosed, brokers.CandleGap{}, false
+	}
+	// часы терминала и компьютера могут расходиться
+	var tolerance = min(duration/2, 30*time.Second)
+	var end = candle.DateTime.Add(duration)
+	if end.After(now.Add(tolerance)) {
+		return candleInProgress, brokers.CandleGap{}, false
+	}
+
+	var key = candleKey{candle.SecurityCode, candle.Interval}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var last, found = f.last[key]
+	if !found {
+		// первый бар подписки должен быть последним закрытым
+		if end.Add(duration + tolerance).Before(now) {
+			return candleStale, brokers.CandleGap{}, false
+		}
+		f.last[key] = candle.DateTime
+		return candleClosed, brokers.CandleGap{}, false
+	}
+	if candle.DateTime.Equal(last) {
+		return candleDuplicate, brokers.CandleGap{}, false
+	}
+	if candle.DateTime.Before(last) {
+		return candleOutOfOrder, brokers.CandleGap{}, false
+	}
+	f.last[key] = candle.DateTime
+	if duration >= 24*time.Hour {
+		return candleClosed, brokers.CandleGap{}, false
+	}
+	var missed = missedCandles(market, last.Add(duration), candle.DateTime, duration)
+	if missed == 0 {
+		return candleClosed, brokers.CandleGap{}, false
+	}
+	return candleClosed, brokers.CandleGap{
+		Interval:     candle.Interval,
+		SecurityCode: candle.SecurityCode,
+		From:         last,
+		To:           candle.DateTime,
+		Missed:       missed,
+	}, true
+}
+
+// Сколько баров должно было начаться в торговое время на [from, to).
+// По неликвидным инструментам QUIK не создает бары без сделок.
+func missedCandles(market moex.Market, from, to time.Time, duration time.Duration) int {
+	var missed int
+	for t := from; t.Before(to); {
+		if moex.IsMarketOpen(market, t) {
+			missed++
+			t = t.Add(duration)
+			continue
+		}
+		var open, ok = moex.NextOpen(market, t)
+		if !ok {
+			break
+		}
+		t = open
+	}
+	return missed
+}
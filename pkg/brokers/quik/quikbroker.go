@@ -6,68 +6,246 @@ import (
 	"github.com/ChizhovVadim/trader/pkg/moex"
 
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"iter"
 	"log/slog"
 	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var _ brokers.IBroker = (*QuikBroker)(nil)
 var _ brokers.IMarketData = (*QuikBroker)(nil)
 
 type QuikBroker struct {
-	logger              *slog.Logger
-	name                string
-	quikService         *quikservice.QuikService
-	marketDataCallbacks chan<- any
-	transId             int64
+	logger      *slog.Logger
+	name        string
+	quikService *quikservice.QuikService
+	callbacks   chan<- any
+	transId     int64
+	mu          sync.Mutex
+	orders      map[string]*quikOrder
+	candles     *candleFilter
+}
+
+const (
+	queryTimeout        = 10 * time.Second
+	historyQueryTimeout = 60 * time.Second
+)
+
+type quikOrder struct {
+	state    brokers.OrderState
+	orderNum int64
+	// день регистрации по Москве
+	date time.Time
 }
 
 func NewQuikBroker(
 	logger *slog.Logger,
 	name string,
 	port int,
-	marketDataCallbacks chan<- any,
+	callbacks chan<- any,
 ) *QuikBroker {
 	logger = logger.With(
 		"client", name,
 		"type", "quik")
 	return &QuikBroker{
-		logger:              logger,
-		name:                name,
-		quikService:         quikservice.New(nil, port, 1),
-		marketDataCallbacks: marketDataCallbacks,
-		transId:             calculateStartTransId(),
+		logger:      logger,
+		name:        name,
+		quikService: quikservice.New(nil, port, 1),
+		callbacks:   callbacks,
+		transId:     calculateStartTransId(),
+		orders:      make(map[string]*quikOrder),
+		candles:     newCandleFilter(),
 	}
 }
 
-func (b *QuikBroker) handleCallbacks(ctx context.Context, cj quikservice.CallbackJson) {
-	if cj.Command == "NewCandle" {
-		if cj.Data != nil && b.marketDataCallbacks != nil {
-			var newCandle quikservice.Candle
-			var err = json.Unmarshal(*cj.Data, &newCandle)
-			if err != nil {
-				return //err
+func (b *QuikBroker) callbackHandlers() *quikservice.CallbackHandlers {
+	if b.callbacks == nil {
+		return nil
+	}
+	return &quikservice.CallbackHandlers{
+		OnNewCandle: func(ctx context.Context, newCandle quikservice.Candle) {
+			var candle = convertToCandle(newCandle)
+			var status, gap, hasGap = b.candles.check(candle,
+				moex.MarketByClassCode(newCandle.ClassCode), time.Now())
+			if status != candleClosed {
+				b.logger.Debug("Skip candle",
+					"security", candle.SecurityCode,
+					"timeframe", candle.Interval,
+					"dateTime", candle.DateTime,
+					"status", status)
+				return
+			}
+			if hasGap {
+				b.publish(ctx, gap)
+			}
+			b.publish(ctx, candle)
+		},
+		OnTransReply: func(ctx context.Context, transReply quikservice.TransReply) {
+			if state, ok := b.onTransReply(transReply); ok {
+				b.publish(ctx, state)
 			}
-			// TODO можно фильтровать слишком ранние бары
-			select {
-			case <-ctx.Done():
-				//return ctx.Err()
-			case b.marketDataCallbacks <- convertToCandle(newCandle):
+		},
+		OnOrder: func(ctx context.Context, order quikservice.Order) {
+			if state, ok := b.onOrder(order); ok {
+				b.publish(ctx, state)
 			}
+		},
+		OnTrade: func(ctx context.Context, trade quikservice.Trade) {
+			b.publish(ctx, b.convertToTrade(trade))
+		},
+		OnStopOrder: func(ctx context.Context, stopOrder quikservice.StopOrder) {
+			b.logger.Debug("OnStopOrder",
+				"orderNum", stopOrder.OrderNum,
+				"security", stopOrder.SecCode,
+				"flags", stopOrder.Flags)
+		},
+		OnFuturesClientHolding: func(ctx context.Context, holding quikservice.FuturesClientHolding) {
+			b.logger.Debug("OnFuturesClientHolding",
+				"portfolio", holding.TrdAccId,
+				"security", holding.SecCode,
+				"totalnet", holding.TotalNet)
+		},
+		OnConnected: func(ctx context.Context) {
+			b.logger.Info("Quik connected")
+			b.publish(ctx, brokers.ConnectionState{Client: b.name, Connected: true})
+		},
+		OnDisconnected: func(ctx context.Context) {
+			b.logger.Warn("Quik disconnected")
+			b.publish(ctx, brokers.ConnectionState{Client: b.name, Connected: false})
+		},
+		OnClose: func(ctx context.Context) {
+			b.logger.Warn("Quik closed")
+			b.publish(ctx, brokers.ConnectionState{Client: b.name, Connected: false})
+		},
+		OnStop: func(ctx context.Context) {
+			b.logger.Warn("Quik script stopped")
+			b.publish(ctx, brokers.ConnectionState{Client: b.name, Connected: false})
+		},
+		OnConnectionLost: func(ctx context.Context) {
+			b.logger.Warn("Quik connection lost")
+			b.publish(ctx, brokers.ConnectionState{Client: b.name, Connected: false})
+		},
+		OnReconnected: func(ctx context.Context) {
+			b.logger.Info("Quik reconnected")
+			b.publish(ctx, brokers.ConnectionState{Client: b.name, Connected: true})
+		},
+		OnError: func(ctx context.Context, cmd string, err error) {
+			b.logger.Warn("Parse callback failed",
+				"cmd", cmd,
+				"error", err)
+		},
+	}
+}
+
+func (b *QuikBroker) convertToTrade(trade quikservice.Trade) brokers.Trade {
+	var res = brokers.Trade{
+		OrderId:      strconv.FormatInt(trade.TransId, 10),
+		Portfolio:    brokers.Portfolio{Client: b.name, Portfolio: trade.Account},
+		SecurityCode: trade.SecCode,
+		DateTime:     trade.Datetime.ToTime(moex.Moscow),
+		Volume:       int(trade.Qty),
+		Price:        trade.Price,
+	}
+	if trade.IsSell() {
+		res.Volume = -res.Volume
+	}
+	b.mu.Lock()
+	if order, found := b.orders[res.OrderId]; found {
+		res.Portfolio = order.state.Order.Portfolio
+	}
+	b.mu.Unlock()
+	return res
+}
+
+func (b *QuikBroker) publish(ctx context.Context, msg any) {
+	select {
+	case <-ctx.Done():
+	case b.callbacks <- msg:
+	}
+}
+
+func (b *QuikBroker) onTransReply(transReply quikservice.TransReply) (brokers.OrderState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var order, found = b.orders[strconv.FormatInt(transReply.TransId, 10)]
+	if !found {
+		return brokers.OrderState{}, false
+	}
+	if transReply.OrderNum != 0 {
+		order.orderNum = transReply.OrderNum
+	}
+	if transReply.Status == quikservice.TransReplyStatusExecuted ||
+		order.state.IsFinal() {
+		return brokers.OrderState{}, false
+	}
+	// 0, 1 - транзакция отправлена, остальные статусы - ошибки.
+	if transReply.Status <= 1 {
+		return brokers.OrderState{}, false
+	}
+	order.state.Status = brokers.OrderStatusRejected
+	order.state.Reason = transReply.ResultMsg
+	b.logger.Warn("Order rejected",
+		"orderId", order.state.Id,
+		"status", transReply.Status,
+		"reason", transReply.ResultMsg)
+	return order.state, true
+}
+
+func (b *QuikBroker) onOrder(quikOrder quikservice.Order) (brokers.OrderState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var order, found = b.orders[strconv.FormatInt(quikOrder.TransId, 10)]
+	if !found {
+		return brokers.OrderState{}, false
+	}
+	order.orderNum = quikOrder.OrderNum
+	if order.state.IsFinal() {
+		return brokers.OrderState{}, false
+	}
+	var newState = applyQuikOrder(order.state, quikOrder)
+	if newState.Status == order.state.Status && newState.FilledVolume == order.state.FilledVolume {
+		return brokers.OrderState{}, false
+	}
+	order.state = newState
+	return order.state, true
+}
+
+// Состояние заявки по данным QUIK.
+func applyQuikOrder(state brokers.OrderState, quikOrder quikservice.Order) brokers.OrderState {
+	var filled = int(quikOrder.Qty - quikOrder.Balance)
+	if state.Order.Volume < 0 {
+		filled = -filled
+	}
+	if quikOrder.IsActive() {
+		if filled == 0 {
+			state.Status = brokers.OrderStatusNew
+		} else {
+			state.Status = brokers.OrderStatusPartiallyFilled
 		}
-		return
+	} else if quikOrder.IsCancelled() {
+		state.Status = brokers.OrderStatusCancelled
+	} else {
+		state.Status = brokers.OrderStatusFilled
 	}
+	state.FilledVolume = filled
+	return state
 }
 
 func (b *QuikBroker) Init(ctx context.Context) error {
-	if err := b.quikService.Init(ctx, b.handleCallbacks); err != nil {
+	var callbackHandler func(context.Context, quikservice.CallbackJson)
+	if handlers := b.callbackHandlers(); handlers != nil {
+		callbackHandler = handlers.Dispatch
+	}
+	if err := b.quikService.Init(ctx, callbackHandler); err != nil {
 		return err
 	}
-	resp, err := b.quikService.IsConnected()
+	var queryCtx, cancel = context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	resp, err := b.quikService.IsConnected(queryCtx)
 	if err != nil {
 		return err
 	}
@@ -88,7 +266,9 @@ func (b *QuikBroker) Close() error {
 }
 
 func (b *QuikBroker) GetPortfolioLimits(portfolio brokers.Portfolio) (brokers.PortfolioLimits, error) {
-	resp, err := b.quikService.GetPortfolioInfoEx(portfolio.Firm, portfolio.Portfolio, 0)
+	var ctx, cancel = context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	resp, err := b.quikService.GetPortfolioInfoEx(ctx, portfolio.Firm, portfolio.Portfolio, 0)
 	if err != nil {
 		return brokers.PortfolioLimits{}, err
 	}
@@ -113,7 +293,9 @@ func (b *QuikBroker) GetPortfolioLimits(portfolio brokers.Portfolio) (brokers.Po
 
 func (b *QuikBroker) GetPosition(portfolio brokers.Portfolio, security brokers.Security) (float64, error) {
 	if security.ClassCode == moex.FuturesClassCode {
-		resp, err := b.quikService.GetFuturesHolding(portfolio.Firm, portfolio.Portfolio, security.Code, 0)
+		var ctx, cancel = context.WithTimeout(context.Background(), queryTimeout)
+		defer cancel()
+		resp, err := b.quikService.GetFuturesHolding(ctx, portfolio.Firm, portfolio.Portfolio, security.Code, 0)
 		if err != nil {
 			return 0, err
 		}
@@ -136,16 +318,17 @@ func (b *QuikBroker) GetPosition(portfolio brokers.Portfolio, security brokers.S
 	}
 }
 
-func (b *QuikBroker) RegisterOrder(order brokers.Order) error {
+func (b *QuikBroker) RegisterOrder(order brokers.Order) (string, error) {
 	var sPrice = formatPrice(order.Security.PriceStep, order.Security.PricePrecision, order.Price)
+	var transId = atomic.AddInt64(&b.transId, 1)
+	var strTransId = fmt.Sprintf("%v", transId)
 	b.logger.Info("RegisterOrder",
 		"portfolio", order.Portfolio.Portfolio,
 		"security", order.Security.Name,
 		"volume", order.Volume,
-		"price", sPrice)
+		"price", sPrice,
+		"orderId", strTransId)
 
-	var transId = atomic.AddInt64(&b.transId, 1)
-	var strTransId = fmt.Sprintf("%v", transId)
 	var trans = quikservice.Transaction{
 		TRANS_ID:    strTransId,
 		ACTION:      "NEW_ORDER",
@@ -162,11 +345,126 @@ func (b *QuikBroker) RegisterOrder(order brokers.Order) error {
 		trans.OPERATION = "S"
 		trans.QUANTITY = strconv.Itoa(-order.Volume)
 	}
-	_, err := b.quikService.SendTransaction(trans)
+
+	// регистрируем до отправки, тк callbacks могут прийти раньше ответа на транзакцию.
+	var today = moexToday()
+	b.mu.Lock()
+	b.evictOrders(today)
+	b.orders[strTransId] = &quikOrder{
+		state: brokers.OrderState{
+			Id:     strTransId,
+			Order:  order,
+			Status: brokers.OrderStatusNew,
+		},
+		date: today,
+	}
+	b.mu.Unlock()
+
+	var ctx, cancel = context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	_, err := b.quikService.SendTransaction(ctx, trans)
+	if err != nil {
+		b.mu.Lock()
+		delete(b.orders, strTransId)
+		b.mu.Unlock()
+		return "", err
+	}
+	return strTransId, nil
+}
+
+// Завершенные заявки прошлых дней больше не нужны.
+// Активные оставляем, тк по ним еще могут прийти callbacks.
+func (b *QuikBroker) evictOrders(today time.Time) {
+	for orderId, order := range b.orders {
+		if order.state.IsFinal() && order.date.Before(today) {
+			delete(b.orders, orderId)
+		}
+	}
+}
+
+func (b *QuikBroker) CancelOrder(portfolio brokers.Portfolio, orderId string) error {
+	b.mu.Lock()
+	var order, found = b.orders[orderId]
+	var orderNum int64
+	var state brokers.OrderState
+	if found {
+		orderNum = order.orderNum
+		state = order.state
+	}
+	b.mu.Unlock()
+	if !found {
+		return fmt.Errorf("order not found %v", orderId)
+	}
+	if state.IsFinal() {
+		return fmt.Errorf("order is not active %v", orderId)
+	}
+	if orderNum == 0 {
+		return fmt.Errorf("order number unknown %v", orderId)
+	}
+	b.logger.Info("CancelOrder",
+		"portfolio", portfolio.Portfolio,
+		"security", state.Order.Security.Name,
+		"orderId", orderId)
+	var transId = atomic.AddInt64(&b.transId, 1)
+	var ctx, cancel = context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	_, err := b.quikService.SendTransaction(ctx, quikservice.Transaction{
+		TRANS_ID:  strconv.FormatInt(transId, 10),
+		ACTION:    "KILL_ORDER",
+		SECCODE:   state.Order.Security.Code,
+		CLASSCODE: state.Order.Security.ClassCode,
+		ORDER_KEY: strconv.FormatInt(orderNum, 10),
+	})
 	return err
 }
 
-func (b *QuikBroker) GetLastCandles(security brokers.Security, timeframe string) iter.Seq2[brokers.HistoryCandle, error] {
+// Состояние активной заявки запрашивается у QUIK,
+// тк callbacks могли потеряться, пока не было соединения.
+// Кэш заявок не меняется: его обновляют только callbacks, которые и публикуют изменения,
+// поэтому вызывающий сам передает результат стратегии (см. StrategyService.Reconcile).
+func (b *QuikBroker) GetOrder(portfolio brokers.Portfolio, orderId string) (brokers.OrderState, error) {
+	b.mu.Lock()
+	var order, found = b.orders[orderId]
+	var state brokers.OrderState
+	var orderNum int64
+	if found {
+		state = order.state
+		orderNum = order.orderNum
+	}
+	b.mu.Unlock()
+	if !found {
+		return brokers.OrderState{}, fmt.Errorf("order not found %v", orderId)
+	}
+	if state.IsFinal() {
+		return state, nil
+	}
+	var ctx, cancel = context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	var quikOrder *quikservice.Order
+	var err error
+	if orderNum != 0 {
+		quikOrder, err = b.quikService.GetOrderByNumber(ctx, state.Order.Security.ClassCode, orderNum)
+	} else {
+		transId, _ := strconv.ParseInt(orderId, 10, 64)
+		quikOrder, err = b.quikService.GetOrderByTransId(ctx, state.Order.Security.ClassCode, state.Order.Security.Code, transId)
+	}
+	if err != nil {
+		return brokers.OrderState{}, err
+	}
+	if quikOrder == nil {
+		return state, nil
+	}
+	var newState = applyQuikOrder(state, *quikOrder)
+	if newState.Status != state.Status || newState.FilledVolume != state.FilledVolume {
+		b.logger.Info("Order state recovered",
+			"orderId", orderId,
+			"status", newState.Status,
+			"filled", newState.FilledVolume)
+	}
+	return newState, nil
+}
+
+func (b *QuikBroker) GetLastCandles(security brokers.Security, timeframe brokers.Timeframe) iter.Seq2[brokers.HistoryCandle, error] {
 	return func(yield func(brokers.HistoryCandle, error) bool) {
 		var candles, err = b.getLastCandles_Impl(security, timeframe)
 		if err != nil {
@@ -182,25 +480,27 @@ func (b *QuikBroker) GetLastCandles(security brokers.Security, timeframe string)
 	}
 }
 
-func (b *QuikBroker) getLastCandles_Impl(security brokers.Security, timeframe string) ([]quikservice.Candle, error) {
+func (b *QuikBroker) getLastCandles_Impl(security brokers.Security, timeframe brokers.Timeframe) ([]quikservice.Candle, error) {
 	var candleInterval, ok = quikTimeframe(timeframe)
 	if !ok {
 		return nil, fmt.Errorf("timeframe not supported %v", timeframe)
 	}
 	const count = 5_000 // Если не указывать размер, то может прийти слишком много баров и unmarshal большой json
-	var candles, err = b.quikService.GetLastCandles(security.ClassCode, security.Code, candleInterval, count)
+	var ctx, cancel = context.WithTimeout(context.Background(), historyQueryTimeout)
+	defer cancel()
+	var candles, err = b.quikService.GetLastCandles(ctx, security.ClassCode, security.Code, candleInterval, count)
 	if err != nil {
 		return nil, err
 	}
-	// последний бар за сегодня может быть не завершен
+	// последний бар может быть не завершен, в том числе недельный или месячный, открытый в прошлые дни
 	if len(candles) > 0 &&
-		isToday(candles[len(candles)-1].Datetime.ToTime(moex.Moscow)) {
+		candleEnd(candles[len(candles)-1].Datetime.ToTime(moex.Moscow), timeframe).After(time.Now()) {
 		candles = candles[:len(candles)-1]
 	}
 	return candles, nil
 }
 
-func (b *QuikBroker) SubscribeCandles(security brokers.Security, timeframe string) error {
+func (b *QuikBroker) SubscribeCandles(security brokers.Security, timeframe brokers.Timeframe) error {
 	var candleInterval, ok = quikTimeframe(timeframe)
 	if !ok {
 		return fmt.Errorf("timeframe not supported %v", timeframe)
@@ -208,6 +508,22 @@ func (b *QuikBroker) SubscribeCandles(security brokers.Security, timeframe strin
 	b.logger.Debug("SubscribeCandles",
 		"security", security.Code,
 		"timeframe", timeframe)
-	_, err := b.quikService.SubscribeCandles(security.ClassCode, security.Code, candleInterval)
+	var ctx, cancel = context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	_, err := b.quikService.SubscribeCandles(ctx, security.ClassCode, security.Code, candleInterval)
+	return err
+}
+
+func (b *QuikBroker) UnsubscribeCandles(security brokers.Security, timeframe brokers.Timeframe) error {
+	var candleInterval, ok = quikTimeframe(timeframe)
+	if !ok {
+		return fmt.Errorf("timeframe not supported %v", timeframe)
+	}
+	b.logger.Debug("UnsubscribeCandles",
+		"security", security.Code,
+		"timeframe", timeframe)
+	var ctx, cancel = context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	_, err := b.quikService.UnsubscribeCandles(ctx, security.ClassCode, security.Code, candleInterval)
 	return err
 }
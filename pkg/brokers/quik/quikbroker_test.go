@@ -0,0 +1,367 @@
+package quik
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+	"github.com/ChizhovVadim/trader/pkg/connectors/quikemulator"
+	"github.com/ChizhovVadim/trader/pkg/connectors/quikservice"
+	"github.com/ChizhovVadim/trader/pkg/moex"
+)
+
+var (
+	testPortfolio = brokers.Portfolio{Client: "quik", Firm: "firm", Portfolio: "acc"}
+	testSecurity  = brokers.Security{
+		Name:           "Si-12.25",
+		Code:           "SiZ5",
+		ClassCode:      moex.FuturesClassCode,
+		PricePrecision: 0,
+		PriceStep:      1,
+		PriceStepCost:  1,
+		Lever:          1,
+	}
+)
+
+const testTimeout = 5 * time.Second
+
+func startEmulator(t *testing.T) *quikemulator.Server {
+	t.Helper()
+	var server = quikemulator.New(nil)
+	if err := server.Start(0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func startQuikBroker(t *testing.T, server *quikemulator.Server, callbacks chan any) *QuikBroker {
+	t.Helper()
+	var logger = slog.New(slog.DiscardHandler)
+	var broker = NewQuikBroker(logger, testPortfolio.Client, server.Port(), callbacks)
+	if err := broker.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return broker
+}
+
+// Ждет сообщение типа T, для которого match вернет true. Остальные сообщения пропускаются.
+func receiveMessage[T any](t *testing.T, callbacks <-chan any, match func(T) bool, push func()) T {
+	t.Helper()
+	var matched = make(chan T, 1)
+	var done = make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case msg := <-callbacks:
+				if v, ok := msg.(T); ok && (match == nil || match(v)) {
+					matched <- v
+					return
+				}
+			}
+		}
+	}()
+	return receive(t, matched, push)
+}
+
+// Ждет значение из канала. Callback соединение эмулятор принимает асинхронно,
+// поэтому push повторяется, пока клиент не получит сообщение.
+func receive[T any](t *testing.T, ch <-chan T, push func()) T {
+	t.Helper()
+	var deadline = time.After(testTimeout)
+	var retry = time.NewTicker(50 * time.Millisecond)
+	defer retry.Stop()
+	if push != nil {
+		push()
+	}
+	for {
+		select {
+		case v := <-ch:
+			return v
+		case <-retry.C:
+			if push != nil {
+				push()
+			}
+		case <-deadline:
+			t.Fatal("timeout")
+		}
+	}
+}
+
+// Callback соединение эмулятор принимает асинхронно.
+func waitCallbacks(t *testing.T, server *quikemulator.Server, callbacks <-chan any) {
+	t.Helper()
+	receiveMessage[brokers.ConnectionState](t, callbacks, nil, func() {
+		server.PushCallback("OnConnected", nil)
+	})
+}
+
+func TestQuikBrokerInit(t *testing.T) {
+	var server = startEmulator(t)
+	startQuikBroker(t, server, nil)
+
+	server.SetResponse("isConnected", 0)
+	var broker = NewQuikBroker(slog.New(slog.DiscardHandler), "quik", server.Port(), nil)
+	defer broker.Close()
+	if err := broker.Init(context.Background()); err == nil {
+		t.Error("Init must fail when QUIK is not connected to the server")
+	}
+}
+
+func TestQuikBrokerPortfolioLimitsAndPosition(t *testing.T) {
+	var server = startEmulator(t)
+	server.SetPortfolio("firm", "acc", map[string]any{
+		"start_limit_open_pos": 500_000,
+		"used_lim_open_pos":    120_000,
+		"varmargin":            -1_500,
+		"fut_accured_int":      300,
+	})
+	server.SetHolding("acc", "SiZ5", 4)
+	var broker = startQuikBroker(t, server, nil)
+
+	limits, err := broker.GetPortfolioLimits(testPortfolio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = brokers.PortfolioLimits{
+		StartLimitOpenPos: 500_000,
+		UsedLimOpenPos:    120_000,
+		VarMargin:         -1_500,
+		AccVarMargin:      300,
+	}
+	if limits != expected {
+		t.Errorf("limits = %+v", limits)
+	}
+
+	position, err := broker.GetPosition(testPortfolio, testSecurity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 4 {
+		t.Errorf("position = %v", position)
+	}
+
+	position, err = broker.GetPosition(testPortfolio, brokers.Security{Code: "RIZ5", ClassCode: moex.FuturesClassCode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 0 {
+		t.Errorf("empty position = %v", position)
+	}
+}
+
+func TestQuikBrokerRegisterOrder(t *testing.T) {
+	var server = startEmulator(t)
+	var callbacks = make(chan any, 64)
+	var broker = startQuikBroker(t, server, callbacks)
+	waitCallbacks(t, server, callbacks)
+
+	orderId, err := broker.RegisterOrder(brokers.Order{
+		Portfolio: testPortfolio,
+		Security:  testSecurity,
+		Volume:    -3,
+		Price:     90_000.4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var transactions = server.Transactions()
+	if len(transactions) != 1 {
+		t.Fatalf("transactions = %+v", transactions)
+	}
+	var trans = transactions[0]
+	if trans.TRANS_ID != orderId || trans.CLIENT_CODE != orderId ||
+		trans.OPERATION != "S" || trans.QUANTITY != "3" || trans.PRICE != "90000" {
+		t.Errorf("transaction = %+v", trans)
+	}
+
+	var trade = receiveMessage(t, callbacks, func(trade brokers.Trade) bool { return trade.OrderId == orderId }, nil)
+	if trade.Volume != -3 || trade.Price != 90_000 || trade.Portfolio != testPortfolio {
+		t.Errorf("trade = %+v", trade)
+	}
+	state, err := broker.GetOrder(testPortfolio, orderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Status != brokers.OrderStatusFilled || state.FilledVolume != -3 {
+		t.Errorf("order = %+v", state)
+	}
+	position, err := broker.GetPosition(testPortfolio, testSecurity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != -3 {
+		t.Errorf("position = %v", position)
+	}
+}
+
+func TestQuikBrokerCancelOrder(t *testing.T) {
+	var server = startEmulator(t)
+	server.SetAutoFill(false)
+	var callbacks = make(chan any, 64)
+	var broker = startQuikBroker(t, server, callbacks)
+	waitCallbacks(t, server, callbacks)
+
+	orderId, err := broker.RegisterOrder(brokers.Order{
+		Portfolio: testPortfolio,
+		Security:  testSecurity,
+		Volume:    1,
+		Price:     90_000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// номер заявки приходит в OnTransReply
+	var deadline = time.Now().Add(testTimeout)
+	for {
+		err = broker.CancelOrder(testPortfolio, orderId)
+		if err == nil || !strings.Contains(err.Error(), "order number unknown") || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state = receiveMessage(t, callbacks, func(state brokers.OrderState) bool { return state.Id == orderId }, nil)
+	if state.Status != brokers.OrderStatusCancelled || state.FilledVolume != 0 {
+		t.Errorf("order = %+v", state)
+	}
+	if err := broker.CancelOrder(testPortfolio, orderId); err == nil {
+		t.Error("cancel of cancelled order must fail")
+	}
+}
+
+// Заявка исполнилась, пока callbacks не доходили: состояние запрашивается у QUIK.
+func TestQuikBrokerGetOrderRecoversState(t *testing.T) {
+	var server = startEmulator(t)
+	server.SetAutoFill(false)
+	var broker = startQuikBroker(t, server, nil)
+
+	orderId, err := broker.RegisterOrder(brokers.Order{
+		Portfolio: testPortfolio,
+		Security:  testSecurity,
+		Volume:    2,
+		Price:     90_000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deadline = time.Now().Add(testTimeout)
+	var state brokers.OrderState
+	for {
+		server.FillOrders()
+		state, err = broker.GetOrder(testPortfolio, orderId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.IsFinal() || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state.Status != brokers.OrderStatusFilled || state.FilledVolume != 2 {
+		t.Errorf("order = %+v", state)
+	}
+}
+
+func TestQuikBrokerGetLastCandles(t *testing.T) {
+	var server = startEmulator(t)
+	var start = time.Date(2025, 10, 14, 10, 0, 0, 0, moex.Moscow)
+	var candles []quikservice.Candle
+	for i := range 3 {
+		candles = append(candles, quikCandle(start.Add(time.Duration(i)*5*time.Minute), float64(100+i), quikservice.CandleIntervalM5))
+	}
+	// текущий бар еще формируется
+	var current = time.Now().In(moex.Moscow).Truncate(5 * time.Minute)
+	candles = append(candles, quikCandle(current, 200, quikservice.CandleIntervalM5))
+	server.SetCandles(testSecurity.ClassCode, testSecurity.Code, quikservice.CandleIntervalM5, candles)
+	var broker = startQuikBroker(t, server, nil)
+
+	var closes []float64
+	for candle, err := range broker.GetLastCandles(testSecurity, brokers.TimeframeM5) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		closes = append(closes, candle.ClosePrice)
+	}
+	if len(closes) != 3 || closes[0] != 100 || closes[2] != 102 {
+		t.Errorf("closes = %v", closes)
+	}
+
+	// недельный бар, открытый в понедельник, еще формируется
+	var y, m, d = time.Now().In(moex.Moscow).Date()
+	var today = time.Date(y, m, d, 0, 0, 0, 0, moex.Moscow)
+	var monday = today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	server.SetCandles(testSecurity.ClassCode, testSecurity.Code, quikservice.CandleIntervalW1, []quikservice.Candle{
+		quikCandle(monday.AddDate(0, 0, -7), 300, quikservice.CandleIntervalW1),
+		quikCandle(monday, 301, quikservice.CandleIntervalW1),
+	})
+	closes = nil
+	for candle, err := range broker.GetLastCandles(testSecurity, brokers.TimeframeW1) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		closes = append(closes, candle.ClosePrice)
+	}
+	if len(closes) != 1 || closes[0] != 300 {
+		t.Errorf("weekly closes = %v", closes)
+	}
+
+	for _, err := range broker.GetLastCandles(testSecurity, brokers.TimeframeTick) {
+		if err == nil {
+			t.Error("tick history must fail")
+		}
+	}
+}
+
+func TestQuikBrokerNewCandle(t *testing.T) {
+	var server = startEmulator(t)
+	var callbacks = make(chan any, 64)
+	var broker = startQuikBroker(t, server, callbacks)
+
+	if err := broker.SubscribeCandles(testSecurity, brokers.TimeframeM1); err != nil {
+		t.Fatal(err)
+	}
+	var subscriptions = server.Subscriptions()
+	if len(subscriptions) != 1 || subscriptions[0] != "SPBFUT|SiZ5|1" {
+		t.Fatalf("subscriptions = %v", subscriptions)
+	}
+
+	// последний закрытый бар, как его отправляет QuikSharp
+	var dateTime = time.Now().In(moex.Moscow).Truncate(time.Minute).Add(-time.Minute)
+	var candle = receiveMessage[brokers.Candle](t, callbacks, nil, func() {
+		server.PushCandle(quikCandle(dateTime, 100, quikservice.CandleIntervalM1))
+	})
+	if candle.Interval != brokers.TimeframeM1 || candle.SecurityCode != "SiZ5" ||
+		!candle.DateTime.Equal(dateTime) || candle.ClosePrice != 100 {
+		t.Errorf("candle = %+v", candle)
+	}
+}
+
+func quikCandle(dateTime time.Time, price float64, interval int) quikservice.Candle {
+	return quikservice.Candle{
+		Open:      price,
+		High:      price,
+		Low:       price,
+		Close:     price,
+		Volume:    1,
+		SecCode:   testSecurity.Code,
+		ClassCode: testSecurity.ClassCode,
+		Interval:  interval,
+		Datetime: quikservice.QuikDateTime{
+			Min:   dateTime.Minute(),
+			Hour:  dateTime.Hour(),
+			Day:   dateTime.Day(),
+			Month: int(dateTime.Month()),
+			Year:  dateTime.Year(),
+		},
+	}
+}
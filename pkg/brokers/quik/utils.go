@@ -1,6 +1,7 @@
 package quik
 
 import (
+	"fmt"
 	"math"
 	"strconv"
 	"time"
@@ -22,10 +23,17 @@ func formatPrice(priceStep float64, pricePrecision int, price float64) string {
 	return strconv.FormatFloat(price, 'f', pricePrecision, 64)
 }
 
-func isToday(d time.Time) bool {
-	var y1, m1, d1 = d.Date()
-	var y2, m2, d2 = time.Now().Date()
-	return y1 == y2 && m1 == m2 && d1 == d2
+func moexToday() time.Time {
+	var y, m, d = time.Now().In(moex.Moscow).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, moex.Moscow)
+}
+
+// Время закрытия бара, открывшегося в start.
+func candleEnd(start time.Time, timeframe brokers.Timeframe) time.Time {
+	if timeframe == brokers.TimeframeMN {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.Add(timeframe.Duration())
 }
 
 func convertToHistoryCandle(item quikservice.Candle) brokers.HistoryCandle {
@@ -41,15 +49,42 @@ func convertToHistoryCandle(item quikservice.Candle) brokers.HistoryCandle {
 
 func convertToCandle(item quikservice.Candle) brokers.Candle {
 	return brokers.Candle{
-		Interval:      "TODO",
+		Interval:      brokersTimeframe(item.Interval),
 		SecurityCode:  item.SecCode,
 		HistoryCandle: convertToHistoryCandle(item),
 	}
 }
 
-func quikTimeframe(timeframe string) (int, bool) {
-	if timeframe == "minutes5" {
-		return quikservice.CandleIntervalM5, true
+var quikTimeframes = map[brokers.Timeframe]int{
+	brokers.TimeframeTick: quikservice.CandleIntervalTick,
+	brokers.TimeframeM1:   quikservice.CandleIntervalM1,
+	brokers.TimeframeM2:   quikservice.CandleIntervalM2,
+	brokers.TimeframeM3:   quikservice.CandleIntervalM3,
+	brokers.TimeframeM4:   quikservice.CandleIntervalM4,
+	brokers.TimeframeM5:   quikservice.CandleIntervalM5,
+	brokers.TimeframeM6:   quikservice.CandleIntervalM6,
+	brokers.TimeframeM10:  quikservice.CandleIntervalM10,
+	brokers.TimeframeM15:  quikservice.CandleIntervalM15,
+	brokers.TimeframeM20:  quikservice.CandleIntervalM20,
+	brokers.TimeframeM30:  quikservice.CandleIntervalM30,
+	brokers.TimeframeH1:   quikservice.CandleIntervalH1,
+	brokers.TimeframeH2:   quikservice.CandleIntervalH2,
+	brokers.TimeframeH4:   quikservice.CandleIntervalH4,
+	brokers.TimeframeD1:   quikservice.CandleIntervalD1,
+	brokers.TimeframeW1:   quikservice.CandleIntervalW1,
+	brokers.TimeframeMN:   quikservice.CandleIntervalMN1,
+}
+
+func quikTimeframe(timeframe brokers.Timeframe) (int, bool) {
+	var interval, found = quikTimeframes[timeframe]
+	return interval, found
+}
+
+func brokersTimeframe(interval int) brokers.Timeframe {
+	for timeframe, quikInterval := range quikTimeframes {
+		if quikInterval == interval {
+			return timeframe
+		}
 	}
-	return 0, false
+	return brokers.Timeframe(fmt.Sprintf("quik%v", interval))
 }
@@ -0,0 +1,89 @@
+package brokers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Таймфрейм баров, например, "minutes5".
+type Timeframe string
+
+const (
+	TimeframeTick Timeframe = "tick"
+	TimeframeM1   Timeframe = "minutes1"
+	TimeframeM2   Timeframe = "minutes2"
+	TimeframeM3   Timeframe = "minutes3"
+	TimeframeM4   Timeframe = "minutes4"
+	TimeframeM5   Timeframe = "minutes5"
+	TimeframeM6   Timeframe = "minutes6"
+	TimeframeM10  Timeframe = "minutes10"
+	TimeframeM15  Timeframe = "minutes15"
+	TimeframeM20  Timeframe = "minutes20"
+	TimeframeM30  Timeframe = "minutes30"
+	TimeframeH1   Timeframe = "hours1"
+	TimeframeH2   Timeframe = "hours2"
+	TimeframeH4   Timeframe = "hours4"
+	TimeframeD1   Timeframe = "days1"
+	TimeframeW1   Timeframe = "weeks1"
+	TimeframeMN   Timeframe = "months1"
+)
+
+var timeframes = []struct {
+	timeframe Timeframe
+	alias     string
+	duration  time.Duration
+}{
+	{TimeframeTick, "tick", 0},
+	{TimeframeM1, "M1", time.Minute},
+	{TimeframeM2, "M2", 2 * time.Minute},
+	{TimeframeM3, "M3", 3 * time.Minute},
+	{TimeframeM4, "M4", 4 * time.Minute},
+	{TimeframeM5, "M5", 5 * time.Minute},
+	{TimeframeM6, "M6", 6 * time.Minute},
+	{TimeframeM10, "M10", 10 * time.Minute},
+	{TimeframeM15, "M15", 15 * time.Minute},
+	{TimeframeM20, "M20", 20 * time.Minute},
+	{TimeframeM30, "M30", 30 * time.Minute},
+	{TimeframeH1, "H1", time.Hour},
+	{TimeframeH2, "H2", 2 * time.Hour},
+	{TimeframeH4, "H4", 4 * time.Hour},
+	{TimeframeD1, "D1", 24 * time.Hour},
+	{TimeframeW1, "W1", 7 * 24 * time.Hour},
+	// длина месяца не постоянна
+	{TimeframeMN, "MN", 0},
+}
+
+// Принимает имена ("minutes5") и короткие обозначения ("M5", "H1", "D1", "MN").
+func ParseTimeframe(s string) (Timeframe, error) {
+	for _, item := range timeframes {
+		if string(item.timeframe) == s || strings.EqualFold(item.alias, s) {
+			return item.timeframe, nil
+		}
+	}
+	return "", fmt.Errorf("bad timeframe %v", s)
+}
+
+// Длительность бара. 0 для тиков и месяцев.
+func (t Timeframe) Duration() time.Duration {
+	for _, item := range timeframes {
+		if item.timeframe == t {
+			return item.duration
+		}
+	}
+	return 0
+}
+
+func (t Timeframe) String() string {
+	return string(t)
+}
+
+// Позиция в порядке возрастания длительности. Неизвестные таймфреймы в конце.
+func (t Timeframe) order() int {
+	for i, item := range timeframes {
+		if item.timeframe == t {
+			return i
+		}
+	}
+	return len(timeframes)
+}
@@ -0,0 +1,212 @@
+// Чтение и запись истории баров в текстовых форматах:
+// Finam и MetaStock (<TICKER>,<PER>,<DATE>,<TIME>,...) и простой CSV (DateTime,Open,High,Low,Close,Volume).
+// Время баров - время открытия бара по Москве.
+package candleio
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+	"github.com/ChizhovVadim/trader/pkg/moex"
+)
+
+// Формат определяется по заголовку файла.
+func ReadFile(path string) iter.Seq2[brokers.HistoryCandle, error] {
+	return func(yield func(brokers.HistoryCandle, error) bool) {
+		var file, err = os.Open(path)
+		if err != nil {
+			yield(brokers.HistoryCandle{}, err)
+			return
+		}
+		defer file.Close()
+		for candle, err := range Read(file) {
+			if err != nil {
+				err = fmt.Errorf("%v: %w", path, err)
+			}
+			if !yield(candle, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Читает бары Finam, MetaStock или CSV, формат и разделитель определяются по заголовку.
+func Read(r io.Reader) iter.Seq2[brokers.HistoryCandle, error] {
+	return func(yield func(brokers.HistoryCandle, error) bool) {
+		var reader = bufio.NewReader(r)
+		var header, err = reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			yield(brokers.HistoryCandle{}, err)
+			return
+		}
+		header = strings.TrimPrefix(strings.TrimSpace(header), "\ufeff")
+		if header == "" {
+			return
+		}
+		var csvReader = csv.NewReader(reader)
+		csvReader.Comma = detectDelimiter(header)
+		csvReader.FieldsPerRecord = -1
+		csvReader.TrimLeadingSpace = true
+		columns, err := parseHeader(strings.Split(header, string(csvReader.Comma)))
+		if err != nil {
+			yield(brokers.HistoryCandle{}, err)
+			return
+		}
+		// заголовок - первая строка
+		var line = 1
+		for {
+			var record, err = csvReader.Read()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					yield(brokers.HistoryCandle{}, err)
+				}
+				return
+			}
+			line += 1
+			if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+				continue
+			}
+			candle, err := columns.parse(record)
+			if err != nil {
+				yield(brokers.HistoryCandle{}, fmt.Errorf("line %v: %w", line, err))
+				return
+			}
+			if !yield(candle, nil) {
+				return
+			}
+		}
+	}
+}
+
+func detectDelimiter(header string) rune {
+	for _, delimiter := range []rune{';', '\t'} {
+		if strings.ContainsRune(header, delimiter) {
+			return delimiter
+		}
+	}
+	return ','
+}
+
+type columns struct {
+	dateTime, date, time        int
+	open, high, low, close, vol int
+}
+
+func parseHeader(fields []string) (columns, error) {
+	var res = columns{dateTime: -1, date: -1, time: -1, open: -1, high: -1, low: -1, close: -1, vol: -1}
+	for i, field := range fields {
+		var name = strings.ToUpper(strings.Trim(strings.TrimSpace(field), "<>"))
+		switch name {
+		case "DATETIME":
+			res.dateTime = i
+		case "DATE", "DTYYYYMMDD":
+			res.date = i
+		case "TIME":
+			res.time = i
+		case "OPEN":
+			res.open = i
+		case "HIGH":
+			res.high = i
+		case "LOW":
+			res.low = i
+		case "CLOSE":
+			res.close = i
+		case "VOL", "VOLUME":
+			res.vol = i
+		}
+	}
+	if res.dateTime == -1 && res.date == -1 {
+		return columns{}, errors.New("date column not found")
+	}
+	if res.close == -1 {
+		return columns{}, errors.New("close column not found")
+	}
+	return res, nil
+}
+
+func (c *columns) parse(record []string) (brokers.HistoryCandle, error) {
+	var field = func(i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	var candle brokers.HistoryCandle
+	var err error
+	if c.dateTime != -1 {
+		candle.DateTime, err = parseDateTime(field(c.dateTime))
+	} else {
+		candle.DateTime, err = parseDate(field(c.date), field(c.time))
+	}
+	if err != nil {
+		return brokers.HistoryCandle{}, err
+	}
+	if candle.ClosePrice, err = strconv.ParseFloat(field(c.close), 64); err != nil {
+		return brokers.HistoryCandle{}, err
+	}
+	// если цен открытия, максимума и минимума нет, то используем цену закрытия
+	for _, item := range []struct {
+		column int
+		value  *float64
+	}{
+		{c.open, &candle.OpenPrice},
+		{c.high, &candle.HighPrice},
+		{c.low, &candle.LowPrice},
+	} {
+		*item.value = candle.ClosePrice
+		if s := field(item.column); s != "" {
+			if *item.value, err = strconv.ParseFloat(s, 64); err != nil {
+				return brokers.HistoryCandle{}, err
+			}
+		}
+	}
+	if s := field(c.vol); s != "" {
+		if candle.Volume, err = strconv.ParseFloat(s, 64); err != nil {
+			return brokers.HistoryCandle{}, err
+		}
+	}
+	return candle, nil
+}
+
+var dateLayouts = []string{"20060102", "02/01/06", "02.01.2006", "2006-01-02", "02/01/2006"}
+var timeLayouts = []string{"150405", "1504", "15:04:05", "15:04"}
+
+func parseDate(date, clock string) (time.Time, error) {
+	var d, err = parseLayouts(dateLayouts, date)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if clock == "" {
+		return d, nil
+	}
+	t, err := parseLayouts(timeLayouts, clock)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(d.Year(), d.Month(), d.Day(), t.Hour(), t.Minute(), t.Second(), 0, moex.Moscow), nil
+}
+
+func parseDateTime(s string) (time.Time, error) {
+	if d, err := time.Parse(time.RFC3339, s); err == nil {
+		return d.In(moex.Moscow), nil
+	}
+	return parseLayouts([]string{time.DateTime, "2006-01-02 15:04", time.DateOnly}, s)
+}
+
+func parseLayouts(layouts []string, s string) (time.Time, error) {
+	for _, layout := range layouts {
+		if d, err := time.ParseInLocation(layout, s, moex.Moscow); err == nil {
+			return d, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad date %q", s)
+}
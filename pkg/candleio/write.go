@@ -0,0 +1,67 @@
+package candleio
+
+import (
+	"bufio"
+	"io"
+	"iter"
+	"strconv"
+	"strings"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+	"github.com/ChizhovVadim/trader/pkg/moex"
+)
+
+// period - период в обозначениях Finam, например, "5" для 5 минут или "D" для дней.
+func WriteFinam(w io.Writer, ticker, period string, candles iter.Seq2[brokers.HistoryCandle, error]) error {
+	return writeTicker(w, "<TICKER>,<PER>,<DATE>,<TIME>,<OPEN>,<HIGH>,<LOW>,<CLOSE>,<VOL>", ticker, period, candles)
+}
+
+func WriteMetaStock(w io.Writer, ticker, period string, candles iter.Seq2[brokers.HistoryCandle, error]) error {
+	return writeTicker(w, "<TICKER>,<PER>,<DTYYYYMMDD>,<TIME>,<OPEN>,<HIGH>,<LOW>,<CLOSE>,<VOL>", ticker, period, candles)
+}
+
+func writeTicker(w io.Writer, header, ticker, period string, candles iter.Seq2[brokers.HistoryCandle, error]) error {
+	var writer = bufio.NewWriter(w)
+	writer.WriteString(header + "\n")
+	for candle, err := range candles {
+		if err != nil {
+			return err
+		}
+		var d = candle.DateTime.In(moex.Moscow)
+		writer.WriteString(strings.Join([]string{
+			ticker,
+			period,
+			d.Format("20060102"),
+			d.Format("150405"),
+			formatFloat(candle.OpenPrice),
+			formatFloat(candle.HighPrice),
+			formatFloat(candle.LowPrice),
+			formatFloat(candle.ClosePrice),
+			formatFloat(candle.Volume),
+		}, ",") + "\n")
+	}
+	return writer.Flush()
+}
+
+func WriteCSV(w io.Writer, candles iter.Seq2[brokers.HistoryCandle, error]) error {
+	var writer = bufio.NewWriter(w)
+	writer.WriteString("DateTime,Open,High,Low,Close,Volume\n")
+	for candle, err := range candles {
+		if err != nil {
+			return err
+		}
+		writer.WriteString(strings.Join([]string{
+			candle.DateTime.In(moex.Moscow).Format("2006-01-02 15:04:05"),
+			formatFloat(candle.OpenPrice),
+			formatFloat(candle.HighPrice),
+			formatFloat(candle.LowPrice),
+			formatFloat(candle.ClosePrice),
+			formatFloat(candle.Volume),
+		}, ",") + "\n")
+	}
+	return writer.Flush()
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,115 @@
+package candlestore
+
+import (
+	"iter"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+)
+
+// Источник баров, который дополняет историю брокера барами из Store
+// и сохраняет в Store новые бары брокера.
+type MarketData struct {
+	logger     *slog.Logger
+	marketData brokers.IMarketData
+	store      *Store
+	mu         sync.Mutex
+	// таймфреймы подписок по коду инструмента
+	subscriptions map[string][]brokers.Timeframe
+}
+
+var _ brokers.IMarketData = (*MarketData)(nil)
+var _ brokers.ICandleHandler = (*MarketData)(nil)
+
+func NewMarketData(
+	logger *slog.Logger,
+	marketData brokers.IMarketData,
+	store *Store,
+) *MarketData {
+	return &MarketData{
+		logger:        logger,
+		marketData:    marketData,
+		store:         store,
+		subscriptions: make(map[string][]brokers.Timeframe),
+	}
+}
+
+// Бары из Store раньше первого бара брокера, затем бары брокера.
+func (m *MarketData) GetLastCandles(security brokers.Security, timeframe brokers.Timeframe) iter.Seq2[brokers.HistoryCandle, error] {
+	return func(yield func(brokers.HistoryCandle, error) bool) {
+		var recent []brokers.HistoryCandle
+		for candle, err := range m.marketData.GetLastCandles(security, timeframe) {
+			if err != nil {
+				yield(brokers.HistoryCandle{}, err)
+				return
+			}
+			recent = append(recent, candle)
+		}
+		for candle, err := range m.store.Candles(security.Code, timeframe) {
+			if err != nil {
+				yield(brokers.HistoryCandle{}, err)
+				return
+			}
+			if len(recent) != 0 && !candle.DateTime.Before(recent[0].DateTime) {
+				break
+			}
+			if !yield(candle, nil) {
+				return
+			}
+		}
+		if err := m.store.Append(security.Code, timeframe, recent...); err != nil {
+			m.logger.Warn("Save candles failed",
+				"security", security.Code,
+				"timeframe", timeframe,
+				"error", err)
+		}
+		var last brokers.HistoryCandle
+		for _, candle := range recent {
+			// брокер может вернуть повторы
+			if !last.DateTime.IsZero() && !candle.DateTime.After(last.DateTime) {
+				continue
+			}
+			last = candle
+			if !yield(candle, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (m *MarketData) SubscribeCandles(security brokers.Security, timeframe brokers.Timeframe) error {
+	m.mu.Lock()
+	if !slices.Contains(m.subscriptions[security.Code], timeframe) {
+		m.subscriptions[security.Code] = append(m.subscriptions[security.Code], timeframe)
+	}
+	m.mu.Unlock()
+	return m.marketData.SubscribeCandles(security, timeframe)
+}
+
+func (m *MarketData) UnsubscribeCandles(security brokers.Security, timeframe brokers.Timeframe) error {
+	m.mu.Lock()
+	m.subscriptions[security.Code] = slices.DeleteFunc(m.subscriptions[security.Code], func(t brokers.Timeframe) bool {
+		return t == timeframe
+	})
+	m.mu.Unlock()
+	return m.marketData.UnsubscribeCandles(security, timeframe)
+}
+
+// Сохраняет бары подписок.
+func (m *MarketData) OnCandle(candle brokers.Candle) {
+	m.mu.Lock()
+	var timeframes = m.subscriptions[candle.SecurityCode]
+	m.mu.Unlock()
+	if !slices.Contains(timeframes, candle.Interval) {
+		return
+	}
+	var timeframe = candle.Interval
+	if err := m.store.Append(candle.SecurityCode, timeframe, candle.HistoryCandle); err != nil {
+		m.logger.Warn("Save candle failed",
+			"security", candle.SecurityCode,
+			"timeframe", timeframe,
+			"error", err)
+	}
+}
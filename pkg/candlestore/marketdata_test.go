@@ -0,0 +1,55 @@
+package candlestore
+
+import (
+	"iter"
+	"log/slog"
+	"slices"
+	"testing"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+)
+
+// История брокера. Остальные методы IMarketData в тестах не вызываются.
+type historyMarketData struct {
+	brokers.IMarketData
+	candles []brokers.HistoryCandle
+}
+
+func (m *historyMarketData) GetLastCandles(security brokers.Security, timeframe brokers.Timeframe) iter.Seq2[brokers.HistoryCandle, error] {
+	return func(yield func(brokers.HistoryCandle, error) bool) {
+		for _, candle := range m.candles {
+			if !yield(candle, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Бары Store раньше истории брокера, затем бары брокера без повторов.
+func TestMarketDataMergesStoreAndBroker(t *testing.T) {
+	var store = New(t.TempDir())
+	if err := store.Append("SiZ5", brokers.TimeframeM5, testCandle(0, 100), testCandle(1, 101), testCandle(2, 102)); err != nil {
+		t.Fatal(err)
+	}
+	var broker = &historyMarketData{candles: []brokers.HistoryCandle{
+		testCandle(2, 202),
+		testCandle(3, 203),
+		testCandle(3, 203),
+		testCandle(4, 204),
+	}}
+	var marketData = NewMarketData(slog.New(slog.DiscardHandler), broker, store)
+	var security = brokers.Security{Code: "SiZ5"}
+
+	var closes = readCloses(t, marketData.GetLastCandles(security, brokers.TimeframeM5))
+	var expected = []float64{100, 101, 202, 203, 204}
+	if !slices.Equal(closes, expected) {
+		t.Errorf("closes = %v", closes)
+	}
+
+	// в Store дописаны только бары позже сохраненных
+	closes = readCloses(t, store.Candles("SiZ5", brokers.TimeframeM5))
+	expected = []float64{100, 101, 102, 203, 204}
+	if !slices.Equal(closes, expected) {
+		t.Errorf("stored closes = %v", closes)
+	}
+}
@@ -0,0 +1,240 @@
+// Локальная история баров: файл на каждую пару инструмент/таймфрейм,
+// в который бары только дописываются.
+package candlestore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+	"github.com/ChizhovVadim/trader/pkg/moex"
+)
+
+const dateTimeLayout = "2006-01-02 15:04:05"
+
+type Store struct {
+	dir string
+	mu  sync.Mutex
+	// время последнего записанного бара по файлу
+	lastTimes map[string]time.Time
+}
+
+func New(dir string) *Store {
+	return &Store{
+		dir:       dir,
+		lastTimes: make(map[string]time.Time),
+	}
+}
+
+func (s *Store) path(securityCode string, timeframe brokers.Timeframe) string {
+	return filepath.Join(s.dir, securityCode+"_"+string(timeframe)+".csv")
+}
+
+// Дописывает бары позже последнего записанного.
+func (s *Store) Append(securityCode string, timeframe brokers.Timeframe, candles ...brokers.HistoryCandle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var path = s.path(securityCode, timeframe)
+	lastTime, err := s.lastTime(path)
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	for _, candle := range candles {
+		if !candle.DateTime.After(lastTime) {
+			continue
+		}
+		lastTime = candle.DateTime
+		formatCandle(&sb, candle)
+	}
+	if sb.Len() == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(sb.String())
+	if err = errors.Join(err, file.Close()); err != nil {
+		return err
+	}
+	s.lastTimes[path] = lastTime
+	return nil
+}
+
+func (s *Store) lastTime(path string) (time.Time, error) {
+	if lastTime, found := s.lastTimes[path]; found {
+		return lastTime, nil
+	}
+	if err := truncateTornLine(path); err != nil {
+		return time.Time{}, err
+	}
+	var lastTime time.Time
+	for candle, err := range readCandles(path, -1) {
+		if err != nil {
+			return time.Time{}, err
+		}
+		lastTime = candle.DateTime
+	}
+	s.lastTimes[path] = lastTime
+	return lastTime, nil
+}
+
+// Бары в порядке времени без повторов. Если файл правили вручную, то из повторов побеждает последний.
+func (s *Store) Candles(securityCode string, timeframe brokers.Timeframe) iter.Seq2[brokers.HistoryCandle, error] {
+	return func(yield func(brokers.HistoryCandle, error) bool) {
+		var path = s.path(securityCode, timeframe)
+		// файл только дописывается, поэтому достаточно прочитать записанное на этот момент.
+		s.mu.Lock()
+		var info, err = os.Stat(path)
+		s.mu.Unlock()
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				yield(brokers.HistoryCandle{}, err)
+			}
+			return
+		}
+		for candle, err := range readCandles(path, info.Size()) {
+			if !yield(candle, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Обрезает недописанную последнюю строку, которая остается после сбоя во время Append,
+// иначе следующие бары допишутся в ее конец.
+func truncateTornLine(path string) error {
+	var file, err = os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	var size = info.Size()
+	var end = size
+	var buf = make([]byte, 4096)
+	for end > 0 {
+		var n = min(int64(len(buf)), end)
+		if _, err := file.ReadAt(buf[:n], end-n); err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+	if end == size {
+		return nil
+	}
+	return file.Truncate(end)
+}
+
+// size < 0 - весь файл.
+// Строка без перевода строки в конце файла не дописана и пропускается.
+func readCandles(path string, size int64) iter.Seq2[brokers.HistoryCandle, error] {
+	return func(yield func(brokers.HistoryCandle, error) bool) {
+		var file, err = os.Open(path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				yield(brokers.HistoryCandle{}, err)
+			}
+			return
+		}
+		defer file.Close()
+		var reader io.Reader = file
+		if size >= 0 {
+			reader = io.LimitReader(file, size)
+		}
+		var (
+			lineReader = bufio.NewReader(reader)
+			line       int
+			pending    brokers.HistoryCandle
+		)
+		for {
+			var text, err = lineReader.ReadString('\n')
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				yield(brokers.HistoryCandle{}, err)
+				return
+			}
+			line += 1
+			candle, err := parseCandle(strings.TrimRight(text, "\r\n"))
+			if err != nil {
+				yield(brokers.HistoryCandle{}, fmt.Errorf("%v line %v: %w", path, line, err))
+				return
+			}
+			if !pending.DateTime.IsZero() {
+				if candle.DateTime.Before(pending.DateTime) {
+					continue
+				}
+				if candle.DateTime.After(pending.DateTime) {
+					if !yield(pending, nil) {
+						return
+					}
+				}
+			}
+			pending = candle
+		}
+		if !pending.DateTime.IsZero() {
+			yield(pending, nil)
+		}
+	}
+}
+
+func formatCandle(sb *strings.Builder, candle brokers.HistoryCandle) {
+	sb.WriteString(candle.DateTime.In(moex.Moscow).Format(dateTimeLayout))
+	for _, value := range []float64{candle.OpenPrice, candle.HighPrice, candle.LowPrice, candle.ClosePrice, candle.Volume} {
+		sb.WriteByte(',')
+		sb.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	sb.WriteByte('\n')
+}
+
+func parseCandle(line string) (brokers.HistoryCandle, error) {
+	var fields = strings.Split(line, ",")
+	if len(fields) != 6 {
+		return brokers.HistoryCandle{}, fmt.Errorf("bad candle %v", line)
+	}
+	dateTime, err := time.ParseInLocation(dateTimeLayout, fields[0], moex.Moscow)
+	if err != nil {
+		return brokers.HistoryCandle{}, err
+	}
+	var values [5]float64
+	for i := range values {
+		values[i], err = strconv.ParseFloat(fields[i+1], 64)
+		if err != nil {
+			return brokers.HistoryCandle{}, err
+		}
+	}
+	return brokers.HistoryCandle{
+		DateTime:   dateTime,
+		OpenPrice:  values[0],
+		HighPrice:  values[1],
+		LowPrice:   values[2],
+		ClosePrice: values[3],
+		Volume:     values[4],
+	}, nil
+}
@@ -0,0 +1,67 @@
+package candlestore
+
+import (
+	"iter"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+	"github.com/ChizhovVadim/trader/pkg/moex"
+)
+
+var testStart = time.Date(2025, 10, 14, 10, 0, 0, 0, moex.Moscow)
+
+func testCandle(i int, price float64) brokers.HistoryCandle {
+	return brokers.HistoryCandle{
+		DateTime:   testStart.Add(time.Duration(i) * 5 * time.Minute),
+		OpenPrice:  price,
+		HighPrice:  price,
+		LowPrice:   price,
+		ClosePrice: price,
+		Volume:     1,
+	}
+}
+
+func readCloses(t *testing.T, candles iter.Seq2[brokers.HistoryCandle, error]) []float64 {
+	t.Helper()
+	var closes []float64
+	for candle, err := range candles {
+		if err != nil {
+			t.Fatal(err)
+		}
+		closes = append(closes, candle.ClosePrice)
+	}
+	return closes
+}
+
+// Сбой во время Append оставляет недописанную строку.
+func TestStoreTornLastLine(t *testing.T) {
+	var dir = t.TempDir()
+	var store = New(dir)
+	if err := store.Append("SiZ5", brokers.TimeframeM5, testCandle(0, 100), testCandle(1, 101)); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(store.path("SiZ5", brokers.TimeframeM5), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString("2025-10-14 10:10:00,102,1"); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	// после перезапуска
+	store = New(dir)
+	var closes = readCloses(t, store.Candles("SiZ5", brokers.TimeframeM5))
+	if len(closes) != 2 || closes[1] != 101 {
+		t.Fatalf("closes = %v", closes)
+	}
+	if err := store.Append("SiZ5", brokers.TimeframeM5, testCandle(2, 102), testCandle(3, 103)); err != nil {
+		t.Fatal(err)
+	}
+	closes = readCloses(t, store.Candles("SiZ5", brokers.TimeframeM5))
+	if len(closes) != 4 || closes[2] != 102 || closes[3] != 103 {
+		t.Errorf("closes = %v", closes)
+	}
+}
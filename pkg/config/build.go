@@ -0,0 +1,151 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+	"github.com/ChizhovVadim/trader/pkg/brokers/quik"
+	"github.com/ChizhovVadim/trader/pkg/candlestore"
+	"github.com/ChizhovVadim/trader/pkg/moex"
+	"github.com/ChizhovVadim/trader/pkg/resample"
+	"github.com/ChizhovVadim/trader/pkg/strategies"
+)
+
+// Настраивает trader по конфигурации.
+// Советники должны быть зарегистрированы в strategies.RegisterAdvisor.
+func Build(
+	logger *slog.Logger,
+	trader *strategies.Trader,
+	robot Robot,
+) error {
+	if err := robot.Validate(); err != nil {
+		return err
+	}
+
+	var baseTimeframe brokers.Timeframe
+	if robot.BaseTimeframe != "" {
+		baseTimeframe, _ = brokers.ParseTimeframe(robot.BaseTimeframe)
+	}
+
+	var brokersByKey = make(map[string]brokers.IBroker)
+	for _, broker := range robot.Brokers {
+		switch broker.Type {
+		case BrokerTypeQuik:
+			brokersByKey[broker.Key] = quik.NewQuikBroker(logger, broker.Key, broker.Port, trader.Inbox())
+		case BrokerTypeMock:
+			var fillTimeframe = baseTimeframe
+			if broker.FillTimeframe != "" {
+				fillTimeframe, _ = brokers.ParseTimeframe(broker.FillTimeframe)
+			}
+			var mock = brokers.NewMockBroker(logger, broker.Key, brokers.MockBrokerConfig{
+				StartAmount:   broker.StartAmount,
+				ExchangeFee:   broker.ExchangeFee,
+				BrokerFee:     broker.BrokerFee,
+				MarginRatio:   broker.MarginRatio,
+				FillTimeframe: fillTimeframe,
+			}, trader.Inbox())
+			trader.AddCandleHandler(mock)
+			brokersByKey[broker.Key] = mock
+		}
+		trader.Broker.Add(broker.Key, brokersByKey[broker.Key])
+	}
+
+	if robot.RolloverDays != 0 {
+		trader.EnableRollover(robot.RolloverDays)
+	}
+	if robot.StateFile != "" {
+		trader.EnableStateStore(strategies.NewFileStateStore(robot.StateFile))
+	}
+	if robot.Reconcile != nil {
+		var reconcile, _ = robot.Reconcile.parse()
+		trader.SetReconcileConfig(reconcile)
+	}
+
+	for _, portfolio := range robot.Portfolios {
+		trader.AddPortfolio(strategies.NewPortfolioService(logger, trader.Broker,
+			&strategies.Portfolio{Portfolio: brokers.Portfolio{
+				Client:    portfolio.Client,
+				Firm:      portfolio.Firm,
+				Portfolio: portfolio.Portfolio,
+			}},
+			portfolio.MaxAmount, portfolio.Weight))
+	}
+
+	var candleStore *candlestore.Store
+	if robot.CandleStore != "" {
+		candleStore = candlestore.New(robot.CandleStore)
+	}
+	var marketDataByKey = make(map[string]brokers.IMarketData)
+
+	for i, signal := range robot.Signals {
+		var fail = func(err error) error {
+			return elementError("Signal", i, fmt.Sprintf("Name=%q", signal.Name), err)
+		}
+		security, err := resolveSecurity(signal.Security, robot.RolloverDays)
+		if err != nil {
+			return fail(err)
+		}
+		marketDataKey, _ := robot.marketDataKey(signal)
+		marketData, found := marketDataByKey[marketDataKey]
+		if !found {
+			var ok bool
+			marketData, ok = brokersByKey[marketDataKey].(brokers.IMarketData)
+			if !ok {
+				return fail(fmt.Errorf("broker %q does not provide market data", marketDataKey))
+			}
+			if candleStore != nil {
+				var storeMarketData = candlestore.NewMarketData(logger, marketData, candleStore)
+				trader.AddCandleHandler(storeMarketData)
+				marketData = storeMarketData
+			}
+			if baseTimeframe != "" {
+				var resampleMarketData = resample.NewMarketData(logger, marketData, baseTimeframe, trader.Inbox())
+				trader.AddCandleHandler(resampleMarketData)
+				marketData = resampleMarketData
+			}
+			marketDataByKey[marketDataKey] = marketData
+		}
+		timeframe, err := brokers.ParseTimeframe(signal.Timeframe)
+		if err != nil {
+			return fail(err)
+		}
+		params, err := signal.advisorParams()
+		if err != nil {
+			return fail(err)
+		}
+		ind, err := strategies.NewAdvisor(signal.Advisor, params)
+		if err != nil {
+			return fail(err)
+		}
+		trader.AddSignal(strategies.NewSignalService(logger, signal.Name, marketData, security,
+			timeframe, ind, signal.SizeConfig))
+	}
+
+	if len(robot.Strategies) == 0 {
+		trader.AddStrategiesForAllSignalPortfolioPairs()
+	} else {
+		var pairs = make(map[Strategy]bool)
+		for _, strategy := range robot.Strategies {
+			pairs[strategy] = true
+		}
+		trader.AddStrategiesForSignalPortfolioPairs(func(signalName string, portfolio brokers.Portfolio) bool {
+			return pairs[Strategy{Signal: signalName, Client: portfolio.Client, Portfolio: portfolio.Portfolio}]
+		})
+	}
+	return nil
+}
+
+// "Si" - ближайший контракт серии, "Si-12.25" - конкретный контракт.
+func resolveSecurity(name string, rolloverDays int) (brokers.Security, error) {
+	if !strings.Contains(name, "-") {
+		var err error
+		name, err = moex.FrontContract(name, time.Now(), rolloverDays)
+		if err != nil {
+			return brokers.Security{}, err
+		}
+	}
+	return moex.GetSecurityInfo(name)
+}
@@ -0,0 +1,311 @@
+// Конфигурация робота из xml или json файла.
+package config
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+	"github.com/ChizhovVadim/trader/pkg/strategies"
+)
+
+type Robot struct {
+	XMLName xml.Name `xml:"Robot" json:"-"`
+	// За сколько дней до экспирации переходить в следующий контракт. 0 - не переходить.
+	RolloverDays int `xml:",attr"`
+	// Файл для сохранения состояния между перезапусками. Пустой - не сохранять.
+	StateFile string `xml:",attr"`
+	// Каталог локальной истории баров. Пустой - история только от брокера.
+	CandleStore string `xml:",attr"`
+	// Таймфрейм подписки у брокера, из которого собираются старшие таймфреймы сигналов.
+	// Пустой - подписка на таймфрейм каждого сигнала.
+	BaseTimeframe string `xml:",attr"`
+	// В json имена элементов те же, что в xml: "Broker", "Portfolio", "Signal".
+	Reconcile  *Reconcile  `xml:"Reconcile" json:"Reconcile"`
+	Brokers    []Broker    `xml:"Broker" json:"Broker"`
+	Portfolios []Portfolio `xml:"Portfolio" json:"Portfolio"`
+	Signals    []Signal    `xml:"Signal" json:"Signal"`
+	// Если не указаны, то каждый сигнал торгуется в каждом портфеле.
+	Strategies []Strategy `xml:"Strategy" json:"Strategy"`
+}
+
+type Reconcile struct {
+	// alert, adopt или correct
+	Policy string `xml:",attr"`
+	// Например, "2m"
+	GracePeriod string `xml:",attr"`
+}
+
+const (
+	BrokerTypeQuik = "quik"
+	BrokerTypeMock = "mock"
+)
+
+type Broker struct {
+	// Ключ для маршрутизации, совпадает с Portfolio.Client
+	Key  string `xml:",attr"`
+	Type string `xml:",attr"`
+	// quik
+	Port int `xml:",attr"`
+	// mock
+	StartAmount float64 `xml:",attr"`
+	ExchangeFee float64 `xml:",attr"`
+	BrokerFee   float64 `xml:",attr"`
+	MarginRatio float64 `xml:",attr"`
+	// Таймфрейм исполнения заявок. По умолчанию BaseTimeframe робота,
+	// а без него самый младший таймфрейм инструмента.
+	FillTimeframe string `xml:",attr"`
+}
+
+type Portfolio struct {
+	Client    string `xml:",attr"`
+	Firm      string `xml:",attr"`
+	Portfolio string `xml:",attr"`
+	// Доля лимита портфеля для робота. 0 - весь лимит.
+	Weight    float64 `xml:",attr"`
+	MaxAmount float64 `xml:",attr"`
+}
+
+type Signal struct {
+	Name string `xml:",attr"`
+	// Серия фьючерсов ("Si") торгуется в ближайшем контракте, или конкретный контракт ("Si-12.25").
+	Security string `xml:",attr"`
+	// Например, "minutes5" или "M5", см. brokers.ParseTimeframe
+	Timeframe string `xml:",attr"`
+	Advisor   string `xml:",attr"`
+	// Параметры советника, см. strategies.RegisterAdvisor
+	Params []Param `xml:"Param" json:"Param"`
+	// Ключ брокера для получения баров. По умолчанию первый брокер quik.
+	MarketData string `xml:",attr"`
+	strategies.SizeConfig
+}
+
+type Param struct {
+	Name  string `xml:",attr"`
+	Value string `xml:",attr"`
+}
+
+func (signal *Signal) advisorParams() (map[string]string, error) {
+	var params = make(map[string]string)
+	for _, param := range signal.Params {
+		if _, found := params[param.Name]; found {
+			return nil, fmt.Errorf("duplicate param %v", param.Name)
+		}
+		params[param.Name] = param.Value
+	}
+	return params, nil
+}
+
+type Strategy struct {
+	Signal    string `xml:",attr"`
+	Client    string `xml:",attr"`
+	Portfolio string `xml:",attr"`
+}
+
+// Ошибка в конкретном элементе конфигурации, например, Signal[2] Name="si".
+type ValidationError struct {
+	Element string
+	Err     error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Element + ": " + e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func elementError(element string, index int, name string, err error) error {
+	return &ValidationError{
+		Element: fmt.Sprintf("%v[%v] %v", element, index+1, name),
+		Err:     err,
+	}
+}
+
+// Формат определяется по расширению файла: .json или xml.
+func Load(path string) (Robot, error) {
+	var content, err = os.ReadFile(path)
+	if err != nil {
+		return Robot{}, err
+	}
+	var robot Robot
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(content, &robot)
+	} else {
+		err = xml.Unmarshal(content, &robot)
+	}
+	if err != nil {
+		return Robot{}, fmt.Errorf("load %v: %w", path, err)
+	}
+	if err := robot.Validate(); err != nil {
+		return Robot{}, fmt.Errorf("load %v: %w", path, err)
+	}
+	return robot, nil
+}
+
+// Проверяет конфигурацию и возвращает все найденные ошибки.
+func (robot *Robot) Validate() error {
+	var errs []error
+	if robot.RolloverDays < 0 {
+		errs = append(errs, &ValidationError{Element: "Robot", Err: errors.New("negative RolloverDays")})
+	}
+	if robot.BaseTimeframe != "" {
+		if _, err := brokers.ParseTimeframe(robot.BaseTimeframe); err != nil {
+			errs = append(errs, &ValidationError{Element: "Robot", Err: err})
+		}
+	}
+	if robot.Reconcile != nil {
+		if _, err := robot.Reconcile.parse(); err != nil {
+			errs = append(errs, &ValidationError{Element: "Reconcile", Err: err})
+		}
+	}
+
+	var brokerTypes = make(map[string]string)
+	for i, broker := range robot.Brokers {
+		var fail = func(err error) {
+			errs = append(errs, elementError("Broker", i, fmt.Sprintf("Key=%q", broker.Key), err))
+		}
+		if broker.Key == "" {
+			fail(errors.New("empty Key"))
+		} else if _, found := brokerTypes[broker.Key]; found {
+			fail(errors.New("duplicate Key"))
+		}
+		switch broker.Type {
+		case BrokerTypeQuik:
+			if broker.Port <= 0 {
+				fail(errors.New("bad Port"))
+			}
+		case BrokerTypeMock:
+			if broker.StartAmount < 0 || broker.MarginRatio < 0 {
+				fail(errors.New("negative StartAmount or MarginRatio"))
+			}
+			if broker.FillTimeframe != "" {
+				if _, err := brokers.ParseTimeframe(broker.FillTimeframe); err != nil {
+					fail(err)
+				}
+			}
+		default:
+			fail(fmt.Errorf("unknown Type %q", broker.Type))
+		}
+		brokerTypes[broker.Key] = broker.Type
+	}
+
+	type portfolioKey struct{ client, portfolio string }
+	var portfolios = make(map[portfolioKey]bool)
+	for i, portfolio := range robot.Portfolios {
+		var fail = func(err error) {
+			errs = append(errs, elementError("Portfolio", i,
+				fmt.Sprintf("Client=%q Portfolio=%q", portfolio.Client, portfolio.Portfolio), err))
+		}
+		if _, found := brokerTypes[portfolio.Client]; !found {
+			fail(fmt.Errorf("broker not found %q", portfolio.Client))
+		}
+		if portfolio.Portfolio == "" {
+			fail(errors.New("empty Portfolio"))
+		}
+		if portfolio.Weight < 0 || portfolio.MaxAmount < 0 {
+			fail(errors.New("negative Weight or MaxAmount"))
+		}
+		var key = portfolioKey{portfolio.Client, portfolio.Portfolio}
+		if portfolios[key] {
+			fail(errors.New("duplicate portfolio"))
+		}
+		portfolios[key] = true
+	}
+
+	var signals = make(map[string]bool)
+	for i, signal := range robot.Signals {
+		var fail = func(err error) {
+			errs = append(errs, elementError("Signal", i, fmt.Sprintf("Name=%q", signal.Name), err))
+		}
+		if signal.Name == "" {
+			fail(errors.New("empty Name"))
+		} else if signals[signal.Name] {
+			fail(errors.New("duplicate Name"))
+		}
+		signals[signal.Name] = true
+		if signal.Security == "" {
+			fail(errors.New("empty Security"))
+		}
+		if signal.Timeframe == "" {
+			fail(errors.New("empty Timeframe"))
+		} else if _, err := brokers.ParseTimeframe(signal.Timeframe); err != nil {
+			fail(err)
+		}
+		if signal.Advisor == "" {
+			fail(errors.New("empty Advisor"))
+		} else if params, err := signal.advisorParams(); err != nil {
+			fail(err)
+		} else if _, err := strategies.NewAdvisor(signal.Advisor, params); err != nil {
+			fail(err)
+		}
+		if _, err := robot.marketDataKey(signal); err != nil {
+			fail(err)
+		}
+		if signal.MaxLever <= 0 {
+			fail(errors.New("MaxLever must be positive"))
+		}
+		// иначе сигнал торгует нулевым объемом
+		if signal.Weight <= 0 {
+			fail(errors.New("Weight must be positive"))
+		}
+		if signal.TargetVolatility < 0 || signal.VolatilityLookback < 0 {
+			fail(errors.New("negative TargetVolatility or VolatilityLookback"))
+		} else if signal.VolatilityLookback == 1 {
+			fail(errors.New("VolatilityLookback must be at least 2"))
+		}
+	}
+
+	for i, strategy := range robot.Strategies {
+		var fail = func(err error) {
+			errs = append(errs, elementError("Strategy", i,
+				fmt.Sprintf("Signal=%q Client=%q Portfolio=%q", strategy.Signal, strategy.Client, strategy.Portfolio), err))
+		}
+		if !signals[strategy.Signal] {
+			fail(fmt.Errorf("signal not found %q", strategy.Signal))
+		}
+		if !portfolios[portfolioKey{strategy.Client, strategy.Portfolio}] {
+			fail(errors.New("portfolio not found"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (robot *Robot) marketDataKey(signal Signal) (string, error) {
+	if signal.MarketData != "" {
+		for _, broker := range robot.Brokers {
+			if broker.Key == signal.MarketData {
+				return broker.Key, nil
+			}
+		}
+		return "", fmt.Errorf("broker not found %q", signal.MarketData)
+	}
+	for _, broker := range robot.Brokers {
+		if broker.Type == BrokerTypeQuik {
+			return broker.Key, nil
+		}
+	}
+	return "", errors.New("market data broker not found")
+}
+
+func (r *Reconcile) parse() (strategies.ReconcileConfig, error) {
+	var policy, err = strategies.ParseReconcilePolicy(r.Policy)
+	if err != nil {
+		return strategies.ReconcileConfig{}, err
+	}
+	var config = strategies.ReconcileConfig{Policy: policy}
+	if r.GracePeriod != "" {
+		config.GracePeriod, err = time.ParseDuration(r.GracePeriod)
+		if err != nil {
+			return strategies.ReconcileConfig{}, err
+		}
+	}
+	return config, nil
+}
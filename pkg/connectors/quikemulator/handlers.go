@@ -0,0 +1,378 @@
+package quikemulator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/connectors/quikservice"
+)
+
+type activeOrder struct {
+	orderNum    int64
+	transaction quikservice.Transaction
+}
+
+// Лимиты, которые вернет getPortfolioInfoEx.
+// Ключи как в QUIK: start_limit_open_pos, used_lim_open_pos, varmargin, fut_accured_int.
+func (s *Server) SetPortfolio(firm, client string, limits map[string]any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.portfolios[firm+"|"+client] = limits
+}
+
+// Позиция, которую вернет getFuturesHolding.
+// Транзакции не содержат фирму, поэтому позиции хранятся по счету без учета фирмы.
+func (s *Server) SetHolding(account, secCode string, totalNet float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holdings[account+"|"+secCode] = totalNet
+}
+
+func (s *Server) Holding(account, secCode string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.holdings[account+"|"+secCode]
+}
+
+// Бары, которые вернет get_candles_from_data_source.
+func (s *Server) SetCandles(classCode, secCode string, interval int, candles []quikservice.Candle) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.candles[fmt.Sprintf("%v|%v|%v", classCode, secCode, interval)] = candles
+}
+
+// Если включено (по умолчанию), то заявки исполняются сразу:
+// эмулятор отправляет OnTransReply, OnOrder, OnTrade и меняет позицию.
+// Иначе заявки остаются активными до FillOrders или KILL_ORDER.
+func (s *Server) SetAutoFill(autoFill bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.autoFill = autoFill
+}
+
+// Полученные транзакции в порядке поступления.
+func (s *Server) Transactions() []quikservice.Transaction {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.transactions)
+}
+
+// Активные подписки вида "class|sec|interval".
+func (s *Server) Subscriptions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.subscriptions)
+}
+
+func parseArgs(data json.RawMessage) ([]string, error) {
+	var args string
+	var err = json.Unmarshal(data, &args)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(args, "|"), nil
+}
+
+func (s *Server) getPortfolioInfoEx(data json.RawMessage) (any, error) {
+	args, err := parseArgs(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 3 {
+		return nil, errors.New("bad arguments")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var limits, found = s.portfolios[args[0]+"|"+args[1]]
+	if !found {
+		return nil, nil
+	}
+	return limits, nil
+}
+
+func (s *Server) getFuturesHolding(data json.RawMessage) (any, error) {
+	args, err := parseArgs(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 4 {
+		return nil, errors.New("bad arguments")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var totalNet, found = s.holdings[args[1]+"|"+args[2]]
+	if !found {
+		return nil, nil
+	}
+	return map[string]any{
+		"firmid":   args[0],
+		"trdaccid": args[1],
+		"sec_code": args[2],
+		"totalnet": totalNet,
+	}, nil
+}
+
+func (s *Server) getCandles(data json.RawMessage) (any, error) {
+	args, err := parseArgs(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 4 {
+		return nil, errors.New("bad arguments")
+	}
+	count, err := strconv.Atoi(args[3])
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var candles = s.candles[args[0]+"|"+args[1]+"|"+args[2]]
+	if count > 0 && len(candles) > count {
+		candles = candles[len(candles)-count:]
+	}
+	return slices.Clone(candles), nil
+}
+
+func (s *Server) subscribeCandles(data json.RawMessage) (any, error) {
+	args, err := parseArgs(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 3 {
+		return nil, errors.New("bad arguments")
+	}
+	var subscription = strings.Join(args, "|")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !slices.Contains(s.subscriptions, subscription) {
+		s.subscriptions = append(s.subscriptions, subscription)
+	}
+	return true, nil
+}
+
+func (s *Server) unsubscribeCandles(data json.RawMessage) (any, error) {
+	args, err := parseArgs(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 3 {
+		return nil, errors.New("bad arguments")
+	}
+	var subscription = strings.Join(args, "|")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions = slices.DeleteFunc(s.subscriptions, func(item string) bool {
+		return item == subscription
+	})
+	return true, nil
+}
+
+func (s *Server) sendTransaction(data json.RawMessage) (any, error) {
+	var trans quikservice.Transaction
+	var err = json.Unmarshal(data, &trans)
+	if err != nil {
+		return nil, err
+	}
+	transId, err := strconv.ParseInt(trans.TRANS_ID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad TRANS_ID %v", trans.TRANS_ID)
+	}
+	s.mu.Lock()
+	s.transactions = append(s.transactions, trans)
+	s.mu.Unlock()
+
+	switch trans.ACTION {
+	case "NEW_ORDER":
+		if _, err := strconv.Atoi(trans.QUANTITY); err != nil {
+			return nil, fmt.Errorf("bad QUANTITY %v", trans.QUANTITY)
+		}
+		s.mu.Lock()
+		s.orderNum += 1
+		var order = &activeOrder{orderNum: s.orderNum, transaction: trans}
+		var autoFill = s.autoFill
+		if !autoFill {
+			s.activeOrders = append(s.activeOrders, order)
+		}
+		s.mu.Unlock()
+		// callbacks отправляем после ответа на транзакцию, как это делает QUIK.
+		go func() {
+			time.Sleep(callbackDelay)
+			s.PushCallback("OnTransReply", quikservice.TransReply{
+				TransId:   transId,
+				Status:    quikservice.TransReplyStatusExecuted,
+				OrderNum:  order.orderNum,
+				SecCode:   trans.SECCODE,
+				ClassCode: trans.CLASSCODE,
+				Account:   trans.ACCOUNT,
+			})
+			if autoFill {
+				s.fill(order)
+			} else {
+				s.pushOrder(order, 0x1)
+			}
+		}()
+		return true, nil
+	case "KILL_ORDER":
+		orderNum, err := strconv.ParseInt(trans.ORDER_KEY, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad ORDER_KEY %v", trans.ORDER_KEY)
+		}
+		var order = s.removeActiveOrder(orderNum)
+		if order == nil {
+			return nil, fmt.Errorf("order not found %v", orderNum)
+		}
+		go func() {
+			time.Sleep(callbackDelay)
+			s.pushOrder(order, 0x2)
+		}()
+		return true, nil
+	default:
+		return nil, fmt.Errorf("action not supported %v", trans.ACTION)
+	}
+}
+
+const callbackDelay = 10 * time.Millisecond
+
+// Исполняет все активные заявки по цене заявки.
+func (s *Server) FillOrders() {
+	s.mu.Lock()
+	var orders = s.activeOrders
+	s.activeOrders = nil
+	s.mu.Unlock()
+	for _, order := range orders {
+		s.fill(order)
+	}
+}
+
+func (s *Server) removeActiveOrder(orderNum int64) *activeOrder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, order := range s.activeOrders {
+		if order.orderNum == orderNum {
+			s.activeOrders = slices.Delete(s.activeOrders, i, i+1)
+			return order
+		}
+	}
+	return nil
+}
+
+func (s *Server) fill(order *activeOrder) {
+	var trans = order.transaction
+	var qty, _ = strconv.ParseInt(trans.QUANTITY, 10, 64)
+	var price, _ = strconv.ParseFloat(trans.PRICE, 64)
+	var transId, _ = strconv.ParseInt(trans.TRANS_ID, 10, 64)
+	var position = float64(qty)
+	var flags int64
+	if trans.OPERATION == "S" {
+		position = -position
+		flags = 0x4
+	}
+	s.mu.Lock()
+	s.holdings[trans.ACCOUNT+"|"+trans.SECCODE] += position
+	s.tradeNum += 1
+	var tradeNum = s.tradeNum
+	s.mu.Unlock()
+
+	s.pushOrder(order, 0)
+	var now = time.Now()
+	s.PushTrade(quikservice.Trade{
+		TradeNum:   tradeNum,
+		OrderNum:   order.orderNum,
+		TransId:    transId,
+		Flags:      flags,
+		SecCode:    trans.SECCODE,
+		ClassCode:  trans.CLASSCODE,
+		Account:    trans.ACCOUNT,
+		ClientCode: trans.CLIENT_CODE,
+		Price:      price,
+		Qty:        qty,
+		Value:      price * float64(qty),
+		Datetime: quikservice.QuikDateTime{
+			Ms:    now.Nanosecond() / int(time.Millisecond),
+			Sec:   now.Second(),
+			Min:   now.Minute(),
+			Hour:  now.Hour(),
+			Day:   now.Day(),
+			Month: int(now.Month()),
+			Year:  now.Year(),
+		},
+	})
+}
+
+// flags: 0x1 - активна, 0x2 - снята, 0 - исполнена.
+func (s *Server) pushOrder(order *activeOrder, flags int64) {
+	var trans = order.transaction
+	var qty, _ = strconv.ParseInt(trans.QUANTITY, 10, 64)
+	var price, _ = strconv.ParseFloat(trans.PRICE, 64)
+	var transId, _ = strconv.ParseInt(trans.TRANS_ID, 10, 64)
+	var balance int64
+	if flags != 0 {
+		balance = qty
+	}
+	if trans.OPERATION == "S" {
+		flags |= 0x4
+	}
+	var quikOrder = quikservice.Order{
+		TransId:   transId,
+		OrderNum:  order.orderNum,
+		Flags:     flags,
+		SecCode:   trans.SECCODE,
+		ClassCode: trans.CLASSCODE,
+		Account:   trans.ACCOUNT,
+		Price:     price,
+		Qty:       qty,
+		Balance:   balance,
+	}
+	s.mu.Lock()
+	s.orders[order.orderNum] = quikOrder
+	s.mu.Unlock()
+	s.PushCallback("OnOrder", quikOrder)
+}
+
+func (s *Server) getOrderByNumber(data json.RawMessage) (any, error) {
+	args, err := parseArgs(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 2 {
+		return nil, errors.New("bad arguments")
+	}
+	orderNum, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var order, found = s.orders[orderNum]
+	if !found || order.ClassCode != args[0] {
+		return nil, nil
+	}
+	return order, nil
+}
+
+func (s *Server) getOrderByTransId(data json.RawMessage) (any, error) {
+	args, err := parseArgs(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 3 {
+		return nil, errors.New("bad arguments")
+	}
+	transId, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, order := range s.orders {
+		if order.TransId == transId && order.ClassCode == args[0] && order.SecCode == args[1] {
+			return order, nil
+		}
+	}
+	return nil, nil
+}
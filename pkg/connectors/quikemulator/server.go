@@ -0,0 +1,323 @@
+package quikemulator
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/connectors/quikservice"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/transform"
+)
+
+// Обработчик запроса. Возвращает data ответа или lua ошибку.
+type Handler func(data json.RawMessage) (any, error)
+
+// Эмулятор lua скрипта QuikSharp.
+// Слушает порт запросов и следующий за ним порт callbacks,
+// протокол - строки json в кодировке Windows-1251.
+type Server struct {
+	logger        *log.Logger
+	mu            sync.Mutex
+	handlers      map[string]Handler
+	mainLn        net.Listener
+	callbackLn    net.Listener
+	conns         []net.Conn
+	callbackConns []*callbackConn
+	wg            sync.WaitGroup
+	portfolios    map[string]map[string]any
+	holdings      map[string]float64
+	candles       map[string][]quikservice.Candle
+	subscriptions []string
+	transactions  []quikservice.Transaction
+	activeOrders  []*activeOrder
+	// последнее состояние заявок по номеру
+	orders   map[int64]quikservice.Order
+	autoFill bool
+	orderNum int64
+	tradeNum int64
+	// сколько ответов накопить, чтобы отправить их в обратном порядке
+	reverseCount int
+}
+
+type callbackConn struct {
+	conn   net.Conn
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+func New(logger *log.Logger) *Server {
+	var s = &Server{
+		logger:     logger,
+		handlers:   make(map[string]Handler),
+		portfolios: make(map[string]map[string]any),
+		holdings:   make(map[string]float64),
+		candles:    make(map[string][]quikservice.Candle),
+		orders:     make(map[int64]quikservice.Order),
+		autoFill:   true,
+	}
+	s.Handle("isConnected", func(json.RawMessage) (any, error) { return 1, nil })
+	s.Handle("message", func(json.RawMessage) (any, error) { return true, nil })
+	s.Handle("getPortfolioInfoEx", s.getPortfolioInfoEx)
+	s.Handle("getFuturesHolding", s.getFuturesHolding)
+	s.Handle("sendTransaction", s.sendTransaction)
+	s.Handle("get_candles_from_data_source", s.getCandles)
+	s.Handle("subscribe_to_candles", s.subscribeCandles)
+	s.Handle("unsubscribe_from_candles", s.unsubscribeCandles)
+	s.Handle("get_order_by_number", s.getOrderByNumber)
+	s.Handle("getOrder_by_ID", s.getOrderByTransId)
+	return s
+}
+
+// Запускает эмулятор на портах port и port+1.
+// Если port = 0, то выбирается свободная пара портов.
+func (s *Server) Start(port int) error {
+	mainLn, callbackLn, err := listen(port)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.mainLn = mainLn
+	s.callbackLn = callbackLn
+	s.mu.Unlock()
+	s.wg.Add(2)
+	go s.acceptMain()
+	go s.acceptCallbacks()
+	return nil
+}
+
+func listen(port int) (net.Listener, net.Listener, error) {
+	const attempts = 10
+	for range attempts {
+		mainLn, err := net.Listen("tcp", "localhost:"+strconv.Itoa(port))
+		if err != nil {
+			return nil, nil, err
+		}
+		var mainPort = mainLn.Addr().(*net.TCPAddr).Port
+		callbackLn, err := net.Listen("tcp", "localhost:"+strconv.Itoa(mainPort+1))
+		if err == nil {
+			return mainLn, callbackLn, nil
+		}
+		mainLn.Close()
+		if port != 0 {
+			return nil, nil, err
+		}
+	}
+	return nil, nil, errors.New("free port pair not found")
+}
+
+// Порт запросов. Порт callbacks на единицу больше.
+func (s *Server) Port() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mainLn.Addr().(*net.TCPAddr).Port
+}
+
+func (s *Server) Close() error {
+	s.mu.Lock()
+	var errs []error
+	if s.mainLn != nil {
+		errs = append(errs, s.mainLn.Close())
+	}
+	if s.callbackLn != nil {
+		errs = append(errs, s.callbackLn.Close())
+	}
+	for _, conn := range s.conns {
+		errs = append(errs, conn.Close())
+	}
+	for _, cc := range s.callbackConns {
+		errs = append(errs, cc.conn.Close())
+	}
+	s.conns = nil
+	s.callbackConns = nil
+	s.mu.Unlock()
+	s.wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Обрывает текущие соединения, не останавливая эмулятор.
+// Имитирует перезапуск lua скрипта.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	for _, cc := range s.callbackConns {
+		cc.conn.Close()
+	}
+	s.conns = nil
+	s.callbackConns = nil
+	s.subscriptions = nil
+}
+
+// Заменяет обработчик команды.
+func (s *Server) Handle(cmd string, handler Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[cmd] = handler
+}
+
+// Следующие n ответов отправляются в обратном порядке, когда накопятся все n.
+// Имитирует lua скрипт, который отвечает на запросы не по порядку.
+func (s *Server) ReverseResponses(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reverseCount = n
+}
+
+// Статический ответ на команду.
+func (s *Server) SetResponse(cmd string, data any) {
+	s.Handle(cmd, func(json.RawMessage) (any, error) { return data, nil })
+}
+
+func (s *Server) acceptMain() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.mainLn.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serve(conn)
+		}()
+	}
+}
+
+func (s *Server) acceptCallbacks() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.callbackLn.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.callbackConns = append(s.callbackConns, &callbackConn{
+			conn:   conn,
+			writer: transform.NewWriter(conn, charmap.Windows1251.NewEncoder()),
+		})
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	var reader = bufio.NewReader(transform.NewReader(conn, charmap.Windows1251.NewDecoder()))
+	var writer = transform.NewWriter(conn, charmap.Windows1251.NewEncoder())
+	var held [][]byte
+	for {
+		incoming, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		var request struct {
+			Id      int64           `json:"id"`
+			Command string          `json:"cmd"`
+			Data    json.RawMessage `json:"data"`
+		}
+		err = json.Unmarshal([]byte(incoming), &request)
+		if err != nil {
+			s.logf("bad request: %v", err)
+			continue
+		}
+		var response = quikservice.ResponseJson{
+			Id:          request.Id,
+			Command:     request.Command,
+			CreatedTime: float64(time.Now().UnixMilli()),
+		}
+		s.mu.Lock()
+		var handler = s.handlers[request.Command]
+		s.mu.Unlock()
+		if handler == nil {
+			response.Command = "lua_error"
+			response.LuaError = fmt.Sprintf("command not found: %v", request.Command)
+		} else if data, err := handler(request.Data); err != nil {
+			response.Command = "lua_error"
+			response.LuaError = err.Error()
+		} else {
+			response.Data = data
+		}
+		b, err := json.Marshal(response)
+		if err != nil {
+			s.logf("marshal response: %v", err)
+			return
+		}
+		var lines = [][]byte{append(b, '\n')}
+		s.mu.Lock()
+		if s.reverseCount > 0 {
+			held = append(held, lines[0])
+			lines = nil
+			if len(held) == s.reverseCount {
+				s.reverseCount = 0
+				slices.Reverse(held)
+				lines, held = held, nil
+			}
+		}
+		s.mu.Unlock()
+		for _, line := range lines {
+			_, err = writer.Write(line)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Отправляет callback всем подключенным клиентам.
+func (s *Server) PushCallback(cmd string, data any) error {
+	b, err := json.Marshal(struct {
+		Command     string  `json:"cmd"`
+		CreatedTime float64 `json:"t"`
+		Data        any     `json:"data"`
+	}{
+		Command:     cmd,
+		CreatedTime: float64(time.Now().UnixMilli()),
+		Data:        data,
+	})
+	if err != nil {
+		return err
+	}
+	return s.PushRawCallback(string(b))
+}
+
+// Отправляет строку как есть, например, испорченный json.
+func (s *Server) PushRawCallback(line string) error {
+	s.mu.Lock()
+	var conns = append([]*callbackConn(nil), s.callbackConns...)
+	s.mu.Unlock()
+	var errs []error
+	for _, cc := range conns {
+		cc.mu.Lock()
+		_, err := cc.writer.Write([]byte(line + "\n"))
+		cc.mu.Unlock()
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) PushCandle(candle quikservice.Candle) error {
+	return s.PushCallback("NewCandle", candle)
+}
+
+func (s *Server) PushTrade(trade quikservice.Trade) error {
+	return s.PushCallback("OnTrade", trade)
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.logger != nil {
+		s.logger.Printf(format, args...)
+	}
+}
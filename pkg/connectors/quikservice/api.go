@@ -1,65 +1,117 @@
 package quikservice
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 )
 
-func (quik *QuikService) IsConnected() (ResponseJson, error) {
-	return quik.MakeQuery("isConnected", "")
+func (quik *QuikService) IsConnected(ctx context.Context) (ResponseJson, error) {
+	return quik.MakeQuery(ctx, "isConnected", "")
 }
 
-func (quik *QuikService) MessageInfo(msg string) (ResponseJson, error) {
-	return quik.MakeQuery("message", msg)
+func (quik *QuikService) MessageInfo(ctx context.Context, msg string) (ResponseJson, error) {
+	return quik.MakeQuery(ctx, "message", msg)
 }
 
 func (quik *QuikService) GetPortfolioInfoEx(
+	ctx context.Context,
 	firmId string,
 	clientCode string,
 	limitKind int,
 ) (ResponseJson, error) {
-	return quik.MakeQuery("getPortfolioInfoEx",
+	return quik.MakeQuery(ctx, "getPortfolioInfoEx",
 		fmt.Sprintf("%v|%v|%v", firmId, clientCode, limitKind))
 }
 
 func (quik *QuikService) GetFuturesHolding(
+	ctx context.Context,
 	firmId string,
 	accId string,
 	secCode string,
 	posType int,
 ) (ResponseJson, error) {
-	return quik.MakeQuery("getFuturesHolding",
+	return quik.MakeQuery(ctx, "getFuturesHolding",
 		fmt.Sprintf("%v|%v|%v|%v", firmId, accId, secCode, posType))
 }
 
 type Transaction struct {
-	TRANS_ID    string
-	ACTION      string
-	ACCOUNT     string
-	CLASSCODE   string
-	SECCODE     string
-	QUANTITY    string
-	OPERATION   string
-	PRICE       string
-	CLIENT_CODE string
+	TRANS_ID    string `json:",omitempty"`
+	ACTION      string `json:",omitempty"`
+	ACCOUNT     string `json:",omitempty"`
+	CLASSCODE   string `json:",omitempty"`
+	SECCODE     string `json:",omitempty"`
+	QUANTITY    string `json:",omitempty"`
+	OPERATION   string `json:",omitempty"`
+	PRICE       string `json:",omitempty"`
+	CLIENT_CODE string `json:",omitempty"`
+	// Номер снимаемой заявки для KILL_ORDER
+	ORDER_KEY string `json:",omitempty"`
 }
 
-func (quik *QuikService) SendTransaction(req Transaction) (ResponseJson, error) {
+func (quik *QuikService) SendTransaction(ctx context.Context, req Transaction) (ResponseJson, error) {
 	//Все значения должны передаваться в виде строк
-	return quik.MakeQuery("sendTransaction", req)
+	return quik.MakeQuery(ctx, "sendTransaction", req)
 }
 
+// Заявка по номеру. nil, если заявка не найдена.
+func (quik *QuikService) GetOrderByNumber(ctx context.Context, classCode string, orderNum int64) (*Order, error) {
+	return quik.queryOrder(ctx, "get_order_by_number",
+		fmt.Sprintf("%v|%v", classCode, orderNum))
+}
+
+// Заявка по TRANS_ID, если номер заявки еще неизвестен. nil, если заявка не найдена.
+func (quik *QuikService) GetOrderByTransId(ctx context.Context, classCode, securityCode string, transId int64) (*Order, error) {
+	return quik.queryOrder(ctx, "getOrder_by_ID",
+		fmt.Sprintf("%v|%v|%v", classCode, securityCode, transId))
+}
+
+func (quik *QuikService) queryOrder(ctx context.Context, cmd string, data string) (*Order, error) {
+	var incoming, err = quik.ExecuteQuery(ctx, cmd, data)
+	if err != nil {
+		return nil, err
+	}
+	var response TResponseJson[*Order]
+	err = json.Unmarshal([]byte(incoming), &response)
+	if err != nil {
+		return nil, err
+	}
+	if response.LuaError != "" {
+		return nil, fmt.Errorf("lua error: %v", response.LuaError)
+	}
+	return response.Data, nil
+}
+
+// Интервалы баров QUIK (INTERVAL_*)
 const (
-	CandleIntervalM5 int = 5
+	CandleIntervalTick int = 0
+	CandleIntervalM1   int = 1
+	CandleIntervalM2   int = 2
+	CandleIntervalM3   int = 3
+	CandleIntervalM4   int = 4
+	CandleIntervalM5   int = 5
+	CandleIntervalM6   int = 6
+	CandleIntervalM10  int = 10
+	CandleIntervalM15  int = 15
+	CandleIntervalM20  int = 20
+	CandleIntervalM30  int = 30
+	CandleIntervalH1   int = 60
+	CandleIntervalH2   int = 120
+	CandleIntervalH4   int = 240
+	CandleIntervalD1   int = 1440
+	CandleIntervalW1   int = 10080
+	CandleIntervalMN1  int = 23200
 )
 
 func (quik *QuikService) GetLastCandles(
+	ctx context.Context,
 	classCode string,
 	securityCode string,
 	interval int,
 	count int,
 ) ([]Candle, error) {
 	var incoming, err = quik.ExecuteQuery(
+		ctx,
 		"get_candles_from_data_source",
 		fmt.Sprintf("%v|%v|%v|%v", classCode, securityCode, interval, count))
 	if err != nil {
@@ -78,11 +130,28 @@ func (quik *QuikService) GetLastCandles(
 }
 
 func (quik *QuikService) SubscribeCandles(
+	ctx context.Context,
+	classCode string,
+	securityCode string,
+	interval int,
+) (ResponseJson, error) {
+	var subscription = fmt.Sprintf("%v|%v|%v", classCode, securityCode, interval)
+	var resp, err = quik.MakeQuery(ctx, "subscribe_to_candles", subscription)
+	if err != nil {
+		return ResponseJson{}, err
+	}
+	quik.addSubscription(subscription)
+	return resp, nil
+}
+
+func (quik *QuikService) UnsubscribeCandles(
+	ctx context.Context,
 	classCode string,
 	securityCode string,
 	interval int,
 ) (ResponseJson, error) {
-	return quik.MakeQuery(
-		"subscribe_to_candles",
-		fmt.Sprintf("%v|%v|%v", classCode, securityCode, interval))
+	var subscription = fmt.Sprintf("%v|%v|%v", classCode, securityCode, interval)
+	// после переподключения подписку не повторяем, даже если запрос не прошел
+	quik.removeSubscription(subscription)
+	return quik.MakeQuery(ctx, "unsubscribe_from_candles", subscription)
 }
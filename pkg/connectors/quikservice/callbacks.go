@@ -0,0 +1,89 @@
+package quikservice
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Типизированные обработчики callbacks QuikSharp.
+// Обработчик nil означает, что событие не интересно.
+type CallbackHandlers struct {
+	OnNewCandle            func(context.Context, Candle)
+	OnTrade                func(context.Context, Trade)
+	OnOrder                func(context.Context, Order)
+	OnTransReply           func(context.Context, TransReply)
+	OnStopOrder            func(context.Context, StopOrder)
+	OnFuturesClientHolding func(context.Context, FuturesClientHolding)
+	OnConnected            func(context.Context)
+	OnDisconnected         func(context.Context)
+	// Закрытие терминала
+	OnClose func(context.Context)
+	// Остановка lua скрипта
+	OnStop func(context.Context)
+	// Обрыв соединения с lua скриптом, QuikService переподключается
+	OnConnectionLost func(context.Context)
+	// Соединение восстановлено, подписки на бары повторены
+	OnReconnected func(context.Context)
+	// Не удалось разобрать данные callback
+	OnError func(ctx context.Context, cmd string, err error)
+}
+
+// Dispatch подходит в качестве callbackHandler для QuikService.Init
+func (h *CallbackHandlers) Dispatch(ctx context.Context, cj CallbackJson) {
+	var err error
+	switch cj.Command {
+	case "NewCandle":
+		err = dispatchData(ctx, cj, h.OnNewCandle)
+	case "OnTrade":
+		err = dispatchData(ctx, cj, h.OnTrade)
+	case "OnOrder":
+		err = dispatchData(ctx, cj, h.OnOrder)
+	case "OnTransReply":
+		err = dispatchData(ctx, cj, h.OnTransReply)
+	case "OnStopOrder":
+		err = dispatchData(ctx, cj, h.OnStopOrder)
+	case "OnFuturesClientHolding":
+		err = dispatchData(ctx, cj, h.OnFuturesClientHolding)
+	case "OnConnected":
+		dispatchEvent(ctx, h.OnConnected)
+	case "OnDisconnected":
+		dispatchEvent(ctx, h.OnDisconnected)
+	case "OnClose":
+		dispatchEvent(ctx, h.OnClose)
+	case "OnStop":
+		dispatchEvent(ctx, h.OnStop)
+	case CallbackConnectionLost:
+		dispatchEvent(ctx, h.OnConnectionLost)
+	case CallbackReconnected:
+		dispatchEvent(ctx, h.OnReconnected)
+	}
+	if err != nil && h.OnError != nil {
+		h.OnError(ctx, cj.Command, err)
+	}
+}
+
+func dispatchData[T any](
+	ctx context.Context,
+	cj CallbackJson,
+	handler func(context.Context, T),
+) error {
+	if handler == nil || cj.Data == nil {
+		return nil
+	}
+	var data T
+	var err = json.Unmarshal(*cj.Data, &data)
+	if err != nil {
+		return err
+	}
+	handler(ctx, data)
+	return nil
+}
+
+func dispatchEvent(
+	ctx context.Context,
+	handler func(context.Context),
+) {
+	if handler != nil {
+		handler(ctx)
+	}
+}
@@ -0,0 +1,201 @@
+package quikservice
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Запрос, ответ на который еще не получен.
+// Несколько запросов могут выполняться одновременно,
+// ответы сопоставляются с запросами по id.
+type Query struct {
+	Id      int64
+	Command string
+	quik    *QuikService
+	conn    net.Conn
+	done    chan queryResult
+}
+
+type queryResult struct {
+	incoming string
+	err      error
+}
+
+// Ответ на запрос не получен до отмены контекста.
+type TimeoutError struct {
+	Command string
+	Id      int64
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("quik query %v (id %v) timeout: %v", e.Command, e.Id, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+var errConnectionLost = errors.New("quik connection lost")
+
+func (quik *QuikService) MakeQuery(ctx context.Context, cmd string, data any) (ResponseJson, error) {
+	var incoming, err = quik.ExecuteQuery(ctx, cmd, data)
+	if err != nil {
+		return ResponseJson{}, err
+	}
+
+	var response ResponseJson
+	err = json.Unmarshal([]byte(incoming), &response)
+	if err != nil {
+		return ResponseJson{}, err
+	}
+	if response.LuaError != "" {
+		return ResponseJson{}, fmt.Errorf("lua error: %v", response.LuaError)
+	}
+	return response, nil
+}
+
+// Синхронная обертка над StartQuery и Query.Wait.
+func (quik *QuikService) ExecuteQuery(ctx context.Context, cmd string, data any) (string, error) {
+	var query, err = quik.StartQuery(cmd, data)
+	if err != nil {
+		return "", err
+	}
+	return query.Wait(ctx)
+}
+
+// Отправляет запрос, не дожидаясь ответа.
+func (quik *QuikService) StartQuery(cmd string, data any) (*Query, error) {
+	quik.mu.Lock()
+	if quik.closed {
+		quik.mu.Unlock()
+		return nil, errClosed
+	}
+	var request = RequestJson{
+		Id:          quik.id,
+		Command:     cmd,
+		CreatedTime: timeToQuikTime(time.Now()),
+		Data:        data,
+	}
+	quik.id += 1
+	var query = &Query{
+		Id:      request.Id,
+		Command: cmd,
+		quik:    quik,
+		conn:    quik.mainConn,
+		done:    make(chan queryResult, 1),
+	}
+	// регистрируем до отправки, тк ответ может прийти раньше, чем завершится Write.
+	quik.pending[query.Id] = query
+	var writer = quik.writer
+	quik.mu.Unlock()
+
+	b, err := json.Marshal(request)
+	if err != nil {
+		quik.removePending(query.Id)
+		return nil, err
+	}
+
+	quik.writeMu.Lock()
+	_, err = writer.Write(append(b, '\r', '\n'))
+	quik.writeMu.Unlock()
+	if err != nil {
+		quik.removePending(query.Id)
+		// закрываем оба соединения, чтобы run переподключился.
+		quik.mu.Lock()
+		if quik.mainConn == query.conn {
+			quik.closeConnections()
+		}
+		quik.mu.Unlock()
+		return nil, err
+	}
+
+	if quik.logger != nil {
+		quik.logger.Println(string(b))
+	}
+	return query, nil
+}
+
+// Ожидает ответ на запрос.
+// При отмене контекста запоздавший ответ будет отброшен читателем по id,
+// поэтому соединение остается в согласованном состоянии.
+func (q *Query) Wait(ctx context.Context) (string, error) {
+	select {
+	case result := <-q.done:
+		return result.incoming, result.err
+	case <-ctx.Done():
+		q.quik.removePending(q.Id)
+		if q.quik.logger != nil {
+			q.quik.logger.Println("query timeout", "cmd", q.Command, "id", q.Id)
+		}
+		return "", &TimeoutError{Command: q.Command, Id: q.Id, Err: ctx.Err()}
+	}
+}
+
+func (quik *QuikService) removePending(id int64) {
+	quik.mu.Lock()
+	defer quik.mu.Unlock()
+	delete(quik.pending, id)
+}
+
+func (quik *QuikService) readResponses(conn net.Conn, reader *bufio.Reader) {
+	for {
+		incoming, err := reader.ReadString('\n')
+		if err != nil {
+			quik.connectionFailed(conn, err)
+			return
+		}
+		if quik.logger != nil && len(incoming) <= 2_048 {
+			quik.logger.Println(incoming)
+		}
+		var header struct {
+			Id int64 `json:"id"`
+		}
+		err = json.Unmarshal([]byte(incoming), &header)
+		if err != nil {
+			if quik.logger != nil {
+				quik.logger.Println("bad response", "error", err)
+			}
+			continue
+		}
+		quik.mu.Lock()
+		var query, found = quik.pending[header.Id]
+		if found {
+			delete(quik.pending, header.Id)
+		}
+		quik.mu.Unlock()
+		if !found {
+			// ответ на запрос, который уже завершился по таймауту
+			if quik.logger != nil {
+				quik.logger.Println("stale response", "id", header.Id)
+			}
+			continue
+		}
+		query.done <- queryResult{incoming: incoming}
+	}
+}
+
+// Завершает с ошибкой запросы, отправленные в оборванное соединение.
+func (quik *QuikService) connectionFailed(conn net.Conn, err error) {
+	quik.mu.Lock()
+	defer quik.mu.Unlock()
+	for id, query := range quik.pending {
+		if query.conn == conn {
+			delete(quik.pending, id)
+			query.done <- queryResult{err: errors.Join(errConnectionLost, err)}
+		}
+	}
+	// закрываем оба соединения, чтобы run переподключился.
+	if quik.mainConn == conn && !quik.closed {
+		quik.closeConnections()
+	}
+}
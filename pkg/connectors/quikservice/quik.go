@@ -5,9 +5,9 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
 	"net"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
@@ -17,25 +17,41 @@ import (
 )
 
 type QuikService struct {
-	logger       *log.Logger
-	port         int
-	id           int64
-	mu           sync.Mutex
-	mainConn     net.Conn
-	reader       *bufio.Reader
-	writer       *transform.Writer
-	callbackConn net.Conn
+	logger        *log.Logger
+	port          int
+	mu            sync.Mutex
+	id            int64
+	mainConn      net.Conn
+	writer        *transform.Writer
+	writeMu       sync.Mutex
+	pending       map[int64]*Query
+	callbackConn  net.Conn
+	closed        bool
+	subscriptions []string
 }
 
+// Синтетические callbacks, которые QuikService отправляет сам при обрыве и восстановлении соединения.
+const (
+	CallbackConnectionLost = "ConnectionLost"
+	CallbackReconnected    = "Reconnected"
+)
+
+const (
+	minReconnectDelay     = 1 * time.Second
+	maxReconnectDelay     = 30 * time.Second
+	reconnectQueryTimeout = 10 * time.Second
+)
+
 func New(
 	logger *log.Logger,
 	port int,
 	id int64,
 ) *QuikService {
 	return &QuikService{
-		logger: logger,
-		port:   port,
-		id:     id,
+		logger:  logger,
+		port:    port,
+		id:      id,
+		pending: make(map[int64]*Query),
 	}
 }
 
@@ -43,29 +59,17 @@ func (quik *QuikService) Init(
 	ctx context.Context,
 	callbackHandler func(context.Context, CallbackJson),
 ) error {
-	mainConn, err := dial(quik.port)
-	if err != nil {
+	if err := quik.connect(); err != nil {
 		return err
 	}
-	quik.mainConn = mainConn
-
-	callbackConn, err := dial(quik.port + 1)
-	if err != nil {
-		return err
-	}
-	quik.callbackConn = callbackConn
-
-	var quikCharmap = charmap.Windows1251
-	quik.reader = bufio.NewReader(transform.NewReader(quik.mainConn, quikCharmap.NewDecoder()))
-	quik.writer = transform.NewWriter(quik.mainConn, quikCharmap.NewEncoder())
 
 	// эта горутина завершатся, тк defer quik.Close() закроет callback connection.
 	// даже если не хотим обрабатывать callbacks, то все равно нужно читать сообщения.
 	go func() {
-		var err = quik.handleCallbacks(ctx, callbackHandler)
+		var err = quik.run(ctx, callbackHandler)
 		if err != nil {
 			if quik.logger != nil {
-				quik.logger.Println("quik.handleCallbacks", "error", err)
+				quik.logger.Println("quik.run", "error", err)
 			}
 			return
 		}
@@ -73,7 +77,43 @@ func (quik *QuikService) Init(
 	return nil
 }
 
+func (quik *QuikService) connect() error {
+	mainConn, err := dial(quik.port)
+	if err != nil {
+		return err
+	}
+	callbackConn, err := dial(quik.port + 1)
+	if err != nil {
+		mainConn.Close()
+		return err
+	}
+
+	quik.mu.Lock()
+	defer quik.mu.Unlock()
+	if quik.closed {
+		return errors.Join(mainConn.Close(), callbackConn.Close(), errClosed)
+	}
+	quik.closeConnections()
+	quik.mainConn = mainConn
+	quik.callbackConn = callbackConn
+	var quikCharmap = charmap.Windows1251
+	var reader = bufio.NewReader(transform.NewReader(mainConn, quikCharmap.NewDecoder()))
+	quik.writer = transform.NewWriter(mainConn, quikCharmap.NewEncoder())
+	// единственный читатель ответов основного соединения
+	go quik.readResponses(mainConn, reader)
+	return nil
+}
+
+var errClosed = errors.New("quik service closed")
+
 func (quik *QuikService) Close() error {
+	quik.mu.Lock()
+	defer quik.mu.Unlock()
+	quik.closed = true
+	return quik.closeConnections()
+}
+
+func (quik *QuikService) closeConnections() error {
 	var mainConnErr, callbackConnErr error
 	if quik.mainConn != nil {
 		mainConnErr = quik.mainConn.Close()
@@ -84,75 +124,120 @@ func (quik *QuikService) Close() error {
 	return errors.Join(mainConnErr, callbackConnErr)
 }
 
-func dial(port int) (net.Conn, error) {
-	return net.Dial("tcp", "localhost:"+strconv.Itoa(port))
+func (quik *QuikService) isClosed() bool {
+	quik.mu.Lock()
+	defer quik.mu.Unlock()
+	return quik.closed
 }
 
-func timeToQuikTime(time time.Time) int64 {
-	return time.UnixNano() / 1000
+// Читает callbacks, а при обрыве соединения переподключается.
+func (quik *QuikService) run(
+	ctx context.Context,
+	callbackHandler func(context.Context, CallbackJson),
+) error {
+	for {
+		var err = quik.handleCallbacks(ctx, callbackHandler)
+		if quik.isClosed() {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if quik.logger != nil {
+			quik.logger.Println("connection lost", "error", err)
+		}
+		if callbackHandler != nil {
+			callbackHandler(ctx, CallbackJson{Command: CallbackConnectionLost})
+		}
+		err = quik.reconnect(ctx)
+		if err != nil {
+			if errors.Is(err, errClosed) {
+				return nil
+			}
+			return err
+		}
+		if callbackHandler != nil {
+			callbackHandler(ctx, CallbackJson{Command: CallbackReconnected})
+		}
+	}
 }
 
-func (quik *QuikService) MakeQuery(cmd string, data any) (ResponseJson, error) {
-	var incoming, err = quik.ExecuteQuery(cmd, data)
-	if err != nil {
-		return ResponseJson{}, err
+func (quik *QuikService) reconnect(ctx context.Context) error {
+	var delay = minReconnectDelay
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if quik.isClosed() {
+			return errClosed
+		}
+		var err = quik.connect()
+		if err == nil {
+			break
+		}
+		if errors.Is(err, errClosed) {
+			return err
+		}
+		if quik.logger != nil {
+			quik.logger.Println("reconnect failed", "error", err)
+		}
+		delay = min(2*delay, maxReconnectDelay)
 	}
-
-	var response ResponseJson
-	err = json.Unmarshal([]byte(incoming), &response)
-	if err != nil {
-		return ResponseJson{}, err
+	if quik.logger != nil {
+		quik.logger.Println("reconnected")
 	}
-	if response.LuaError != "" {
-		return ResponseJson{}, fmt.Errorf("lua error: %v", response.LuaError)
+	// подписки живут в lua скрипте, поэтому после перезапуска их нужно повторить.
+	for _, subscription := range quik.activeSubscriptions() {
+		var queryCtx, cancel = context.WithTimeout(ctx, reconnectQueryTimeout)
+		var _, err = quik.MakeQuery(queryCtx, "subscribe_to_candles", subscription)
+		cancel()
+		if err != nil && quik.logger != nil {
+			quik.logger.Println("resubscribe failed", "subscription", subscription, "error", err)
+		}
 	}
-	return response, nil
+	return nil
 }
 
-func (quik *QuikService) ExecuteQuery(cmd string, data any) (string, error) {
+func (quik *QuikService) addSubscription(subscription string) {
 	quik.mu.Lock()
 	defer quik.mu.Unlock()
-
-	var request = RequestJson{
-		Id:          quik.id,
-		Command:     cmd,
-		CreatedTime: timeToQuikTime(time.Now()),
-		Data:        data,
+	if !slices.Contains(quik.subscriptions, subscription) {
+		quik.subscriptions = append(quik.subscriptions, subscription)
 	}
-	quik.id += 1
+}
 
-	b, err := json.Marshal(request)
-	if err != nil {
-		return "", err
-	}
-	_, err = quik.writer.Write(b)
-	if err != nil {
-		return "", err
-	}
-	_, err = quik.writer.Write([]byte("\r\n"))
-	if err != nil {
-		return "", err
-	}
+func (quik *QuikService) removeSubscription(subscription string) {
+	quik.mu.Lock()
+	defer quik.mu.Unlock()
+	quik.subscriptions = slices.DeleteFunc(quik.subscriptions, func(s string) bool {
+		return s == subscription
+	})
+}
 
-	if quik.logger != nil {
-		quik.logger.Println(string(b))
-	}
+func (quik *QuikService) activeSubscriptions() []string {
+	quik.mu.Lock()
+	defer quik.mu.Unlock()
+	return slices.Clone(quik.subscriptions)
+}
 
-	incoming, err := quik.reader.ReadString('\n')
-	if err != nil {
-		return "", err
-	}
-	if quik.logger != nil && len(incoming) <= 2_048 {
-		quik.logger.Println(incoming)
-	}
-	return incoming, nil
+func dial(port int) (net.Conn, error) {
+	return net.Dial("tcp", "localhost:"+strconv.Itoa(port))
+}
+
+func timeToQuikTime(time time.Time) int64 {
+	return time.UnixNano() / 1000
 }
 
 func (quik *QuikService) handleCallbacks(
 	ctx context.Context,
 	callbackHandler func(context.Context, CallbackJson),
 ) error {
-	reader := bufio.NewReader(transform.NewReader(quik.callbackConn, charmap.Windows1251.NewDecoder()))
+	quik.mu.Lock()
+	var callbackConn = quik.callbackConn
+	quik.mu.Unlock()
+	reader := bufio.NewReader(transform.NewReader(callbackConn, charmap.Windows1251.NewDecoder()))
 	for {
 		incoming, err := reader.ReadString('\n')
 		if err != nil {
@@ -161,7 +246,11 @@ func (quik *QuikService) handleCallbacks(
 		var callbackJson CallbackJson
 		err = json.Unmarshal([]byte(incoming), &callbackJson)
 		if err != nil {
-			return err
+			// соединение исправно, пропускаем только испорченную строку
+			if quik.logger != nil {
+				quik.logger.Println("bad callback", "line", incoming, "error", err)
+			}
+			continue
 		}
 		if callbackHandler != nil {
 			callbackHandler(ctx, callbackJson)
@@ -0,0 +1,342 @@
+package quikservice_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/connectors/quikemulator"
+	"github.com/ChizhovVadim/trader/pkg/connectors/quikservice"
+)
+
+const testTimeout = 5 * time.Second
+
+func startEmulator(t *testing.T) *quikemulator.Server {
+	t.Helper()
+	var server = quikemulator.New(nil)
+	if err := server.Start(0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func startQuikService(t *testing.T, server *quikemulator.Server, handlers *quikservice.CallbackHandlers) *quikservice.QuikService {
+	t.Helper()
+	var ctx, cancel = context.WithCancel(context.Background())
+	var quik = quikservice.New(nil, server.Port(), 1)
+	var callbackHandler func(context.Context, quikservice.CallbackJson)
+	if handlers != nil {
+		callbackHandler = handlers.Dispatch
+	}
+	if err := quik.Init(ctx, callbackHandler); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		quik.Close()
+	})
+	return quik
+}
+
+func testContext(t *testing.T) context.Context {
+	var ctx, cancel = context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// Ждет значение из канала. Callback соединение эмулятор принимает асинхронно,
+// поэтому push повторяется, пока клиент не получит сообщение.
+func receive[T any](t *testing.T, ch <-chan T, push func()) T {
+	t.Helper()
+	var deadline = time.After(testTimeout)
+	var retry = time.NewTicker(50 * time.Millisecond)
+	defer retry.Stop()
+	if push != nil {
+		push()
+	}
+	for {
+		select {
+		case v := <-ch:
+			return v
+		case <-retry.C:
+			if push != nil {
+				push()
+			}
+		case <-deadline:
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestQuikServiceIsConnected(t *testing.T) {
+	var server = startEmulator(t)
+	var quik = startQuikService(t, server, nil)
+
+	resp, err := quik.IsConnected(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := quikservice.ParseInt(resp.Data); res != 1 {
+		t.Fatalf("isConnected = %v", resp.Data)
+	}
+
+	server.SetResponse("isConnected", 0)
+	resp, err = quik.IsConnected(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := quikservice.ParseInt(resp.Data); res != 0 {
+		t.Fatalf("isConnected = %v", resp.Data)
+	}
+}
+
+func TestQuikServicePortfolioAndHolding(t *testing.T) {
+	var server = startEmulator(t)
+	server.SetPortfolio("firm", "acc", map[string]any{
+		"start_limit_open_pos": 1_000_000,
+		"varmargin":            -150.5,
+	})
+	server.SetHolding("acc", "SiZ5", -3)
+	var quik = startQuikService(t, server, nil)
+
+	resp, err := quik.GetPortfolioInfoEx(testContext(t), "firm", "acc", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var limits = quikservice.AsMap(resp.Data)
+	if v, _ := quikservice.ParseFloat(limits["start_limit_open_pos"]); v != 1_000_000 {
+		t.Errorf("start_limit_open_pos = %v", limits["start_limit_open_pos"])
+	}
+	if v, _ := quikservice.ParseFloat(limits["varmargin"]); v != -150.5 {
+		t.Errorf("varmargin = %v", limits["varmargin"])
+	}
+
+	resp, err = quik.GetPortfolioInfoEx(testContext(t), "firm", "unknown", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data != nil {
+		t.Errorf("unknown portfolio = %v", resp.Data)
+	}
+
+	resp, err = quik.GetFuturesHolding(testContext(t), "firm", "acc", "SiZ5", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var holding = quikservice.AsMap(resp.Data)
+	if v, _ := quikservice.ParseFloat(holding["totalnet"]); v != -3 {
+		t.Errorf("totalnet = %v", holding["totalnet"])
+	}
+}
+
+func TestQuikServiceSendTransaction(t *testing.T) {
+	var server = startEmulator(t)
+	var trades = make(chan quikservice.Trade, 1)
+	var connected = make(chan struct{}, 16)
+	var quik = startQuikService(t, server, &quikservice.CallbackHandlers{
+		OnTrade:     func(_ context.Context, trade quikservice.Trade) { trades <- trade },
+		OnConnected: func(context.Context) { connected <- struct{}{} },
+	})
+	// иначе OnTrade может уйти раньше, чем эмулятор примет callback соединение
+	receive(t, connected, func() { server.PushCallback("OnConnected", nil) })
+
+	_, err := quik.SendTransaction(testContext(t), quikservice.Transaction{
+		TRANS_ID:    "42",
+		ACTION:      "NEW_ORDER",
+		ACCOUNT:     "acc",
+		CLASSCODE:   "SPBFUT",
+		SECCODE:     "SiZ5",
+		OPERATION:   "S",
+		QUANTITY:    "2",
+		PRICE:       "90000",
+		CLIENT_CODE: "42",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trade = receive(t, trades, nil)
+	if trade.TransId != 42 || trade.Qty != 2 || !trade.IsSell() || trade.Price != 90000 {
+		t.Errorf("trade = %+v", trade)
+	}
+	if pos := server.Holding("acc", "SiZ5"); pos != -2 {
+		t.Errorf("holding = %v", pos)
+	}
+	var transactions = server.Transactions()
+	if len(transactions) != 1 || transactions[0].TRANS_ID != "42" {
+		t.Errorf("transactions = %+v", transactions)
+	}
+}
+
+func TestQuikServiceGetLastCandles(t *testing.T) {
+	var server = startEmulator(t)
+	var candles []quikservice.Candle
+	for i := range 5 {
+		candles = append(candles, quikservice.Candle{
+			Close:    float64(100 + i),
+			Datetime: quikservice.QuikDateTime{Year: 2025, Month: 10, Day: 14, Hour: 10, Min: 5 * i},
+		})
+	}
+	server.SetCandles("SPBFUT", "SiZ5", quikservice.CandleIntervalM5, candles)
+	var quik = startQuikService(t, server, nil)
+
+	res, err := quik.GetLastCandles(testContext(t), "SPBFUT", "SiZ5", quikservice.CandleIntervalM5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Close != 103 || res[1].Close != 104 {
+		t.Errorf("candles = %+v", res)
+	}
+
+	res, err = quik.GetLastCandles(testContext(t), "SPBFUT", "SiZ5", quikservice.CandleIntervalH1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Errorf("other interval candles = %+v", res)
+	}
+}
+
+func TestQuikServiceSubscribeCandles(t *testing.T) {
+	var server = startEmulator(t)
+	var candles = make(chan quikservice.Candle, 16)
+	var quik = startQuikService(t, server, &quikservice.CallbackHandlers{
+		OnNewCandle: func(_ context.Context, candle quikservice.Candle) { candles <- candle },
+	})
+
+	_, err := quik.SubscribeCandles(testContext(t), "SPBFUT", "SiZ5", quikservice.CandleIntervalM5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subscription = "SPBFUT|SiZ5|" + strconv.Itoa(quikservice.CandleIntervalM5)
+	if !slices.Contains(server.Subscriptions(), subscription) {
+		t.Fatalf("subscriptions = %v", server.Subscriptions())
+	}
+
+	var candle = receive(t, candles, func() {
+		server.PushCandle(quikservice.Candle{
+			Close:     100,
+			SecCode:   "SiZ5",
+			ClassCode: "SPBFUT",
+			Interval:  quikservice.CandleIntervalM5,
+		})
+	})
+	if candle.SecCode != "SiZ5" || candle.Interval != quikservice.CandleIntervalM5 || candle.Close != 100 {
+		t.Errorf("candle = %+v", candle)
+	}
+}
+
+func TestQuikServiceResubscribeAfterReconnect(t *testing.T) {
+	var server = startEmulator(t)
+	var reconnected = make(chan struct{}, 1)
+	var quik = startQuikService(t, server, &quikservice.CallbackHandlers{
+		OnReconnected: func(context.Context) { reconnected <- struct{}{} },
+	})
+	_, err := quik.SubscribeCandles(testContext(t), "SPBFUT", "SiZ5", quikservice.CandleIntervalM5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.DropConnections()
+	receive(t, reconnected, nil)
+	if len(server.Subscriptions()) != 1 {
+		t.Errorf("subscriptions = %v", server.Subscriptions())
+	}
+	if _, err := quik.IsConnected(testContext(t)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQuikServiceSkipsBadCallback(t *testing.T) {
+	var server = startEmulator(t)
+	var connected = make(chan struct{}, 16)
+	var lost = make(chan struct{}, 1)
+	startQuikService(t, server, &quikservice.CallbackHandlers{
+		OnConnected:      func(context.Context) { connected <- struct{}{} },
+		OnConnectionLost: func(context.Context) { lost <- struct{}{} },
+	})
+	receive(t, connected, func() { server.PushCallback("OnConnected", nil) })
+
+	if err := server.PushRawCallback(`{"cmd":"OnTrade","data":`); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.PushCallback("OnConnected", nil); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, connected, nil)
+	select {
+	case <-lost:
+		t.Error("bad callback must not drop the connection")
+	default:
+	}
+}
+
+// Ответ пришел после таймаута: запрос завершается TimeoutError,
+// запоздавший ответ отбрасывается, а соединение остается рабочим.
+func TestQuikServiceQueryTimeout(t *testing.T) {
+	var server = startEmulator(t)
+	server.Handle("slow", func(json.RawMessage) (any, error) {
+		time.Sleep(300 * time.Millisecond)
+		return "slow", nil
+	})
+	var quik = startQuikService(t, server, nil)
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := quik.MakeQuery(ctx, "slow", nil)
+	var timeoutErr *quikservice.TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("err = %v", err)
+	}
+	if timeoutErr.Command != "slow" || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("timeout error = %+v", timeoutErr)
+	}
+
+	// эмулятор отвечает по порядку: сначала придет ответ на slow
+	resp, err := quik.IsConnected(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id == timeoutErr.Id || resp.Command != "isConnected" {
+		t.Fatalf("response = %+v", resp)
+	}
+	if res, _ := quikservice.ParseInt(resp.Data); res != 1 {
+		t.Errorf("isConnected = %v", resp.Data)
+	}
+}
+
+// Ответы приходят в обратном порядке: каждый запрос получает свой ответ по id.
+func TestQuikServicePipelinedQueries(t *testing.T) {
+	var server = startEmulator(t)
+	server.Handle("echo", func(data json.RawMessage) (any, error) { return data, nil })
+	var quik = startQuikService(t, server, nil)
+
+	const n = 5
+	server.ReverseResponses(n)
+	var queries []*quikservice.Query
+	for i := range n {
+		query, err := quik.StartQuery("echo", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries = append(queries, query)
+	}
+	for i, query := range queries {
+		incoming, err := query.Wait(testContext(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp quikservice.ResponseJson
+		if err := json.Unmarshal([]byte(incoming), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if res, _ := quikservice.ParseInt(resp.Data); resp.Id != query.Id || res != i {
+			t.Errorf("query %v: response = %+v", i, resp)
+		}
+	}
+}
@@ -41,6 +41,92 @@ type Candle struct {
 	Interval  int          `json:"interval"`
 }
 
+// Ответ на транзакцию (OnTransReply)
+type TransReply struct {
+	TransId   int64  `json:"trans_id"`
+	Status    int64  `json:"status"`
+	ResultMsg string `json:"result_msg"`
+	OrderNum  int64  `json:"order_num"`
+	SecCode   string `json:"sec_code"`
+	ClassCode string `json:"class_code"`
+	Account   string `json:"account"`
+	Quantity  int64  `json:"quantity"`
+	Balance   int64  `json:"balance"`
+}
+
+// Статус TransReply: транзакция выполнена
+const TransReplyStatusExecuted = 3
+
+// Заявка (OnOrder)
+type Order struct {
+	TransId   int64   `json:"trans_id"`
+	OrderNum  int64   `json:"order_num"`
+	Flags     int64   `json:"flags"`
+	SecCode   string  `json:"sec_code"`
+	ClassCode string  `json:"class_code"`
+	Account   string  `json:"account"`
+	Price     float64 `json:"price"`
+	Qty       int64   `json:"qty"`
+	Balance   int64   `json:"balance"`
+}
+
+// Заявка активна
+func (o *Order) IsActive() bool {
+	return o.Flags&0x1 != 0
+}
+
+// Заявка снята
+func (o *Order) IsCancelled() bool {
+	return !o.IsActive() && o.Flags&0x2 != 0
+}
+
+// Сделка (OnTrade)
+type Trade struct {
+	TradeNum   int64        `json:"trade_num"`
+	OrderNum   int64        `json:"order_num"`
+	TransId    int64        `json:"trans_id"`
+	Flags      int64        `json:"flags"`
+	SecCode    string       `json:"sec_code"`
+	ClassCode  string       `json:"class_code"`
+	Account    string       `json:"account"`
+	ClientCode string       `json:"client_code"`
+	Price      float64      `json:"price"`
+	Qty        int64        `json:"qty"`
+	Value      float64      `json:"value"`
+	Datetime   QuikDateTime `json:"datetime"`
+}
+
+// Сделка на продажу
+func (t *Trade) IsSell() bool {
+	return t.Flags&0x4 != 0
+}
+
+// Стоп-заявка (OnStopOrder)
+type StopOrder struct {
+	OrderNum       int64   `json:"order_num"`
+	TransId        int64   `json:"trans_id"`
+	Flags          int64   `json:"flags"`
+	StopOrderType  int64   `json:"stop_order_type"`
+	SecCode        string  `json:"sec_code"`
+	ClassCode      string  `json:"class_code"`
+	Account        string  `json:"account"`
+	Price          float64 `json:"price"`
+	ConditionPrice float64 `json:"condition_price"`
+	Qty            int64   `json:"qty"`
+}
+
+// Позиция по клиентскому счету (фьючерсы) (OnFuturesClientHolding)
+type FuturesClientHolding struct {
+	FirmId       string  `json:"firmid"`
+	TrdAccId     string  `json:"trdaccid"`
+	SecCode      string  `json:"sec_code"`
+	Type         int64   `json:"type"`
+	StartNet     float64 `json:"startnet"`
+	TotalNet     float64 `json:"totalnet"`
+	AvrPosnPrice float64 `json:"avrposnprice"`
+	VarMargin    float64 `json:"varmargin"`
+}
+
 type QuikDateTime struct {
 	Ms    int `json:"ms"`
 	Sec   int `json:"sec"`
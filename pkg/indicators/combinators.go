@@ -0,0 +1,141 @@
+package indicators
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+)
+
+type weightedIndicator struct {
+	ind    Indicator
+	weight float64
+}
+
+// Взвешенная сумма индикаторов. Готова, когда готовы все слагаемые.
+type WeightedSum struct {
+	items []weightedIndicator
+}
+
+func NewWeightedSum() *WeightedSum {
+	return &WeightedSum{}
+}
+
+func (ind *WeightedSum) With(item Indicator, weight float64) *WeightedSum {
+	ind.items = append(ind.items, weightedIndicator{ind: item, weight: weight})
+	return ind
+}
+
+func (ind *WeightedSum) Add(d time.Time, value float64) bool {
+	var ready = true
+	for _, item := range ind.items {
+		// добавляем во все индикаторы, даже если какой-то еще не готов
+		if !item.ind.Add(d, value) {
+			ready = false
+		}
+	}
+	return ready
+}
+
+func (ind *WeightedSum) AddCandle(candle brokers.HistoryCandle) bool {
+	var ready = true
+	for _, item := range ind.items {
+		if !addCandle(item.ind, candle) {
+			ready = false
+		}
+	}
+	return ready
+}
+
+func (ind *WeightedSum) Value() float64 {
+	var sum float64
+	for _, item := range ind.items {
+		sum += item.weight * item.ind.Value()
+	}
+	return sum
+}
+
+// Ограничивает значение индикатора отрезком [-1, +1].
+type Clamp struct {
+	ind Indicator
+}
+
+func NewClamp(ind Indicator) *Clamp {
+	return &Clamp{ind: ind}
+}
+
+func (c *Clamp) Add(d time.Time, value float64) bool {
+	return c.ind.Add(d, value)
+}
+
+func (c *Clamp) AddCandle(candle brokers.HistoryCandle) bool {
+	return addCandle(c.ind, candle)
+}
+
+func (c *Clamp) Value() float64 {
+	return clamp(c.ind.Value())
+}
+
+// Знак значения индикатора: -1, 0 или +1.
+type Sign struct {
+	ind Indicator
+}
+
+func NewSign(ind Indicator) *Sign {
+	return &Sign{ind: ind}
+}
+
+func (s *Sign) Add(d time.Time, value float64) bool {
+	return s.ind.Add(d, value)
+}
+
+func (s *Sign) AddCandle(candle brokers.HistoryCandle) bool {
+	return addCandle(s.ind, candle)
+}
+
+func (s *Sign) Value() float64 {
+	var value = s.ind.Value()
+	if value > 0 {
+		return 1
+	}
+	if value < 0 {
+		return -1
+	}
+	return 0
+}
+
+// Значение индикатора n баров назад.
+type Lag struct {
+	ind    Indicator
+	values ring
+}
+
+func NewLag(ind Indicator, n int) (*Lag, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("bad lag %v", n)
+	}
+	return &Lag{ind: ind, values: newRing(n + 1)}, nil
+}
+
+func (l *Lag) Add(d time.Time, value float64) bool {
+	return l.push(l.ind.Add(d, value))
+}
+
+func (l *Lag) AddCandle(candle brokers.HistoryCandle) bool {
+	return l.push(addCandle(l.ind, candle))
+}
+
+func (l *Lag) push(ready bool) bool {
+	if !ready {
+		return false
+	}
+	l.values.push(l.ind.Value())
+	return l.values.full()
+}
+
+func (l *Lag) Value() float64 {
+	if !l.values.full() {
+		return 0
+	}
+	return l.values.at(len(l.values.values) - 1)
+}
@@ -0,0 +1,77 @@
+// Потоковые индикаторы для советников.
+// Все индикаторы удовлетворяют strategies.Indicator: Add получает цену закрытия очередного бара
+// и возвращает true, когда индикатор накопил достаточно истории, Value возвращает текущее значение.
+// Память выделяется только в конструкторах, конструкторы возвращают ошибку при неверном периоде.
+package indicators
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+)
+
+// Совпадает с strategies.Indicator.
+// Пакет не импортирует strategies, чтобы стратегии и советники могли использовать индикаторы.
+type Indicator interface {
+	Add(d time.Time, value float64) bool
+	Value() float64
+}
+
+// Совпадает с strategies.CandleIndicator: индикатор, которому нужен весь бар.
+// Комбинаторы передают бары целиком вложенным индикаторам.
+type CandleIndicator interface {
+	Indicator
+	AddCandle(candle brokers.HistoryCandle) bool
+}
+
+func addCandle(ind Indicator, candle brokers.HistoryCandle) bool {
+	if ind, ok := ind.(CandleIndicator); ok {
+		return ind.AddCandle(candle)
+	}
+	return ind.Add(candle.DateTime, candle.ClosePrice)
+}
+
+func checkPeriod(period, minPeriod int) error {
+	if period < minPeriod {
+		return fmt.Errorf("bad period %v", period)
+	}
+	return nil
+}
+
+// Кольцевой буфер последних значений.
+type ring struct {
+	values []float64
+	next   int
+	count  int
+}
+
+// size проверяет вызывающий.
+func newRing(size int) ring {
+	return ring{values: make([]float64, size)}
+}
+
+// Добавляет значение. Если буфер заполнен, возвращает вытесненное значение.
+func (r *ring) push(value float64) (old float64, evicted bool) {
+	if r.count == len(r.values) {
+		old, evicted = r.values[r.next], true
+	} else {
+		r.count += 1
+	}
+	r.values[r.next] = value
+	r.next = (r.next + 1) % len(r.values)
+	return old, evicted
+}
+
+func (r *ring) full() bool {
+	return r.count == len(r.values)
+}
+
+// i=0 - последнее добавленное значение.
+func (r *ring) at(i int) float64 {
+	return r.values[(r.next-1-i+2*len(r.values))%len(r.values)]
+}
+
+func clamp(x float64) float64 {
+	return max(-1, min(1, x))
+}
@@ -0,0 +1,64 @@
+package indicators
+
+import "time"
+
+// Простое скользящее среднее.
+type SMA struct {
+	values ring
+	sum    float64
+}
+
+func NewSMA(period int) (*SMA, error) {
+	if err := checkPeriod(period, 1); err != nil {
+		return nil, err
+	}
+	return &SMA{values: newRing(period)}, nil
+}
+
+func (ind *SMA) Add(d time.Time, value float64) bool {
+	var old, evicted = ind.values.push(value)
+	ind.sum += value
+	if evicted {
+		ind.sum -= old
+	}
+	return ind.values.full()
+}
+
+func (ind *SMA) Value() float64 {
+	if ind.values.count == 0 {
+		return 0
+	}
+	return ind.sum / float64(ind.values.count)
+}
+
+// Экспоненциальное скользящее среднее. Готово после period значений.
+type EMA struct {
+	period int
+	alpha  float64
+	count  int
+	value  float64
+}
+
+func NewEMA(period int) (*EMA, error) {
+	if err := checkPeriod(period, 1); err != nil {
+		return nil, err
+	}
+	return &EMA{
+		period: period,
+		alpha:  2 / float64(period+1),
+	}, nil
+}
+
+func (ind *EMA) Add(d time.Time, value float64) bool {
+	if ind.count == 0 {
+		ind.value = value
+	} else {
+		ind.value += ind.alpha * (value - ind.value)
+	}
+	ind.count += 1
+	return ind.count >= ind.period
+}
+
+func (ind *EMA) Value() float64 {
+	return ind.value
+}
@@ -0,0 +1,174 @@
+package indicators
+
+import (
+	"math"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+)
+
+// Изменение цены за period баров в единицах ATR.
+// Деление на sqrt(period) делает значения сопоставимыми для разных периодов.
+type Momentum struct {
+	period int
+	prices ring
+	atr    ATR
+}
+
+func NewMomentum(period, atrPeriod int) (*Momentum, error) {
+	if err := checkPeriod(period, 1); err != nil {
+		return nil, err
+	}
+	var atr, err = NewATR(atrPeriod)
+	if err != nil {
+		return nil, err
+	}
+	return &Momentum{
+		period: period,
+		prices: newRing(period + 1),
+		atr:    *atr,
+	}, nil
+}
+
+func (ind *Momentum) Add(d time.Time, value float64) bool {
+	ind.prices.push(value)
+	var atrReady = ind.atr.Add(d, value)
+	return atrReady && ind.prices.full()
+}
+
+// ATR по истинному диапазону бара.
+func (ind *Momentum) AddCandle(candle brokers.HistoryCandle) bool {
+	ind.prices.push(candle.ClosePrice)
+	var atrReady = ind.atr.AddCandle(candle)
+	return atrReady && ind.prices.full()
+}
+
+func (ind *Momentum) Value() float64 {
+	var atr = ind.atr.Value()
+	if !ind.prices.full() || atr == 0 {
+		return 0
+	}
+	var change = ind.prices.at(0) - ind.prices.at(ind.period)
+	return change / (atr * math.Sqrt(float64(ind.period)))
+}
+
+// RSI Уайлдера, приведенный к отрезку [-1, +1]: (RSI-50)/50.
+type RSI struct {
+	period    int
+	count     int
+	avgGain   float64
+	avgLoss   float64
+	lastPrice float64
+	hasPrice  bool
+}
+
+func NewRSI(period int) (*RSI, error) {
+	if err := checkPeriod(period, 1); err != nil {
+		return nil, err
+	}
+	return &RSI{period: period}, nil
+}
+
+func (ind *RSI) Add(d time.Time, value float64) bool {
+	if !ind.hasPrice {
+		ind.lastPrice, ind.hasPrice = value, true
+		return false
+	}
+	var change = value - ind.lastPrice
+	ind.lastPrice = value
+	var gain, loss = max(change, 0), max(-change, 0)
+	ind.count += 1
+	if ind.count <= ind.period {
+		// первые period изменений - простое среднее
+		ind.avgGain += (gain - ind.avgGain) / float64(ind.count)
+		ind.avgLoss += (loss - ind.avgLoss) / float64(ind.count)
+	} else {
+		var n = float64(ind.period)
+		ind.avgGain = (ind.avgGain*(n-1) + gain) / n
+		ind.avgLoss = (ind.avgLoss*(n-1) + loss) / n
+	}
+	return ind.count >= ind.period
+}
+
+func (ind *RSI) Value() float64 {
+	var total = ind.avgGain + ind.avgLoss
+	if total == 0 {
+		return 0
+	}
+	// (RSI-50)/50, где RSI = 100*gain/(gain+loss)
+	return (ind.avgGain - ind.avgLoss) / total
+}
+
+// Отклонение цены от скользящего среднего в стандартных отклонениях (полосы Боллинджера).
+type BollingerZ struct {
+	prices ring
+	sum    float64
+	sumSq  float64
+}
+
+func NewBollingerZ(period int) (*BollingerZ, error) {
+	if err := checkPeriod(period, 2); err != nil {
+		return nil, err
+	}
+	return &BollingerZ{prices: newRing(period)}, nil
+}
+
+func (ind *BollingerZ) Add(d time.Time, value float64) bool {
+	var old, evicted = ind.prices.push(value)
+	ind.sum += value
+	ind.sumSq += value * value
+	if evicted {
+		ind.sum -= old
+		ind.sumSq -= old * old
+	}
+	return ind.prices.full()
+}
+
+func (ind *BollingerZ) Value() float64 {
+	var n = float64(ind.prices.count)
+	if n < 2 {
+		return 0
+	}
+	var mean = ind.sum / n
+	var variance = (ind.sumSq - ind.sum*mean) / (n - 1)
+	if variance <= 0 {
+		return 0
+	}
+	return (ind.prices.at(0) - mean) / math.Sqrt(variance)
+}
+
+// Пробой канала Дончиана: +1 после закрытия выше максимума предыдущих period баров,
+// -1 после закрытия ниже минимума, иначе сохраняет предыдущее значение.
+type Donchian struct {
+	prices ring
+	value  float64
+}
+
+func NewDonchian(period int) (*Donchian, error) {
+	if err := checkPeriod(period, 1); err != nil {
+		return nil, err
+	}
+	return &Donchian{prices: newRing(period)}, nil
+}
+
+func (ind *Donchian) Add(d time.Time, value float64) bool {
+	var ready = ind.prices.full()
+	if ready {
+		var high, low = ind.prices.at(0), ind.prices.at(0)
+		for i := 1; i < ind.prices.count; i++ {
+			high = max(high, ind.prices.at(i))
+			low = min(low, ind.prices.at(i))
+		}
+		if value > high {
+			ind.value = 1
+		} else if value < low {
+			ind.value = -1
+		}
+	}
+	ind.prices.push(value)
+	return ready
+}
+
+func (ind *Donchian) Value() float64 {
+	return ind.value
+}
@@ -0,0 +1,135 @@
+package indicators
+
+import (
+	"math"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+)
+
+// Средний истинный диапазон: экспоненциальное среднее max(high, prevClose) - min(low, prevClose).
+// Если известна только цена закрытия (Add), то диапазон бара - модуль изменения цены.
+type ATR struct {
+	ema       EMA
+	lastPrice float64
+	hasPrice  bool
+}
+
+func NewATR(period int) (*ATR, error) {
+	var ema, err = NewEMA(period)
+	if err != nil {
+		return nil, err
+	}
+	return &ATR{ema: *ema}, nil
+}
+
+func (ind *ATR) Add(d time.Time, value float64) bool {
+	return ind.AddCandle(brokers.HistoryCandle{
+		DateTime:   d,
+		HighPrice:  value,
+		LowPrice:   value,
+		ClosePrice: value,
+	})
+}
+
+func (ind *ATR) AddCandle(candle brokers.HistoryCandle) bool {
+	if !ind.hasPrice {
+		ind.lastPrice, ind.hasPrice = candle.ClosePrice, true
+		return false
+	}
+	var trueRange = max(candle.HighPrice, ind.lastPrice) - min(candle.LowPrice, ind.lastPrice)
+	ind.lastPrice = candle.ClosePrice
+	return ind.ema.Add(candle.DateTime, trueRange)
+}
+
+func (ind *ATR) Value() float64 {
+	return ind.ema.Value()
+}
+
+// Стандартное отклонение логарифмических доходностей за period баров (close-to-close).
+type Volatility struct {
+	returns   ring
+	sum       float64
+	sumSq     float64
+	lastPrice float64
+}
+
+func NewVolatility(period int) (*Volatility, error) {
+	if err := checkPeriod(period, 2); err != nil {
+		return nil, err
+	}
+	return &Volatility{returns: newRing(period)}, nil
+}
+
+// Неположительные цены пропускаются: доходность по ним не определена.
+func (ind *Volatility) Add(d time.Time, value float64) bool {
+	if value <= 0 {
+		return ind.returns.full()
+	}
+	if ind.lastPrice == 0 {
+		ind.lastPrice = value
+		return false
+	}
+	var ret = math.Log(value / ind.lastPrice)
+	ind.lastPrice = value
+	var old, evicted = ind.returns.push(ret)
+	ind.sum += ret
+	ind.sumSq += ret * ret
+	if evicted {
+		ind.sum -= old
+		ind.sumSq -= old * old
+	}
+	return ind.returns.full()
+}
+
+func (ind *Volatility) Value() float64 {
+	var n = float64(ind.returns.count)
+	if n < 2 {
+		return 0
+	}
+	var variance = (ind.sumSq - ind.sum*ind.sum/n) / (n - 1)
+	return math.Sqrt(max(0, variance))
+}
+
+// Экспоненциально взвешенная волатильность логарифмических доходностей (как в RiskMetrics).
+type EwmaVolatility struct {
+	period    int
+	alpha     float64
+	count     int
+	variance  float64
+	lastPrice float64
+}
+
+func NewEwmaVolatility(period int) (*EwmaVolatility, error) {
+	if err := checkPeriod(period, 1); err != nil {
+		return nil, err
+	}
+	return &EwmaVolatility{
+		period: period,
+		alpha:  2 / float64(period+1),
+	}, nil
+}
+
+// Неположительные цены пропускаются, как в Volatility.
+func (ind *EwmaVolatility) Add(d time.Time, value float64) bool {
+	if value <= 0 {
+		return ind.count >= ind.period
+	}
+	if ind.lastPrice == 0 {
+		ind.lastPrice = value
+		return false
+	}
+	var ret = math.Log(value / ind.lastPrice)
+	ind.lastPrice = value
+	if ind.count == 0 {
+		ind.variance = ret * ret
+	} else {
+		ind.variance += ind.alpha * (ret*ret - ind.variance)
+	}
+	ind.count += 1
+	return ind.count >= ind.period
+}
+
+func (ind *EwmaVolatility) Value() float64 {
+	return math.Sqrt(ind.variance)
+}
@@ -0,0 +1,192 @@
+package moex
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Правила последнего дня торгов:
+// "" и "3thu" - третий четверг месяца исполнения,
+// "3fri" - третья пятница месяца исполнения,
+// "1bd" - первый рабочий день месяца исполнения.
+var expirationRules = []string{"", "3thu", "3fri", "1bd", "perpetual"}
+
+var ErrPerpetual = errors.New("perpetual futures has no expiration")
+
+type contractName struct {
+	base  string
+	month int
+	year  int
+}
+
+// Вечные фьючерсы отмечены в спецификации правилом экспирации "perpetual".
+func isPerpetual(spec FuturesSpec) bool {
+	return spec.Expiration == "perpetual"
+}
+
+// Sample: "Si-3.17" -> {Si 3 2017}
+func parseContractName(securityName string) (contractName, error) {
+	var base, expiration, ok = strings.Cut(securityName, "-")
+	if !ok {
+		return contractName{}, fmt.Errorf("bad security name %v", securityName)
+	}
+	var sMonth, sYear, found = strings.Cut(expiration, ".")
+	if !found {
+		return contractName{}, fmt.Errorf("bad security name %v", securityName)
+	}
+	month, err := strconv.Atoi(sMonth)
+	if err != nil {
+		return contractName{}, err
+	}
+	if month < 1 || month > 12 {
+		return contractName{}, fmt.Errorf("bad month %v", securityName)
+	}
+	year, err := strconv.Atoi(sYear)
+	if err != nil {
+		return contractName{}, err
+	}
+	return contractName{base: base, month: month, year: 2000 + year%100}, nil
+}
+
+func (c contractName) String() string {
+	return fmt.Sprintf("%v-%v.%02d", c.base, c.month, c.year%100)
+}
+
+func parseMonths(months string) ([]int, error) {
+	if months == "" {
+		return []int{3, 6, 9, 12}, nil
+	}
+	var res []int
+	for _, field := range strings.Fields(months) {
+		var month, err = strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+		if month < 1 || month > 12 {
+			return nil, fmt.Errorf("bad month %v", month)
+		}
+		res = append(res, month)
+	}
+	if len(res) == 0 {
+		return nil, errors.New("empty months")
+	}
+	return res, nil
+}
+
+// Последний день торгов контракта, например, "Si-12.25".
+func ExpirationDate(securityName string) (time.Time, error) {
+	var spec, found = GetFuturesSpec(baseName(securityName))
+	if !found {
+		return time.Time{}, fmt.Errorf("secInfo not found %v", securityName)
+	}
+	if isPerpetual(spec) {
+		return time.Time{}, ErrPerpetual
+	}
+	var contract, err = parseContractName(securityName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return expirationDate(spec.Expiration, contract.year, contract.month), nil
+}
+
+func expirationDate(rule string, year, month int) time.Time {
+	var first = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, Moscow)
+	switch rule {
+	case "3fri":
+		return nthWeekday(first, time.Friday, 3)
+	case "1bd":
+		var d = first
+		for !IsBusinessDay(d) {
+			d = d.AddDate(0, 0, 1)
+		}
+		return d
+	default:
+		return nthWeekday(first, time.Thursday, 3)
+	}
+}
+
+func nthWeekday(first time.Time, weekday time.Weekday, n int) time.Time {
+	var offset = (int(weekday) - int(first.Weekday()) + 7) % 7
+	return first.AddDate(0, 0, offset+7*(n-1))
+}
+
+// Следующий контракт серии: "Si-12.25" -> "Si-3.26".
+func NextContract(securityName string) (string, error) {
+	var spec, found = GetFuturesSpec(baseName(securityName))
+	if !found {
+		return "", fmt.Errorf("secInfo not found %v", securityName)
+	}
+	if isPerpetual(spec) {
+		return "", ErrPerpetual
+	}
+	var contract, err = parseContractName(securityName)
+	if err != nil {
+		return "", err
+	}
+	months, err := parseMonths(spec.Months)
+	if err != nil {
+		return "", err
+	}
+	for _, month := range months {
+		if month > contract.month {
+			contract.month = month
+			return contract.String(), nil
+		}
+	}
+	contract.month = months[0]
+	contract.year += 1
+	return contract.String(), nil
+}
+
+// Ближайший контракт серии name (например, "Si"),
+// до последнего дня торгов которого на дату date остается больше daysBefore дней.
+// Для вечных фьючерсов возвращает name.
+func FrontContract(name string, date time.Time, daysBefore int) (string, error) {
+	var spec, found = GetFuturesSpec(name)
+	if !found {
+		return "", fmt.Errorf("secInfo not found %v", name)
+	}
+	if isPerpetual(spec) {
+		return name, nil
+	}
+	months, err := parseMonths(spec.Months)
+	if err != nil {
+		return "", err
+	}
+	var contract = contractName{base: name, month: months[0], year: date.Year()}
+	for _, month := range months {
+		if month >= int(date.Month()) {
+			contract.month = month
+			break
+		}
+	}
+	if contract.month < int(date.Month()) {
+		contract.year += 1
+	}
+	for {
+		var expiration = expirationDate(spec.Expiration, contract.year, contract.month)
+		if DaysUntil(date, expiration) > daysBefore {
+			return contract.String(), nil
+		}
+		next, err := NextContract(contract.String())
+		if err != nil {
+			return "", err
+		}
+		contract, err = parseContractName(next)
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// Количество календарных дней от date до expiration.
+func DaysUntil(date, expiration time.Time) int {
+	var y1, m1, d1 = date.In(Moscow).Date()
+	var y2, m2, d2 = expiration.In(Moscow).Date()
+	var from = time.Date(y1, m1, d1, 0, 0, 0, 0, time.UTC)
+	var to = time.Date(y2, m2, d2, 0, 0, 0, 0, time.UTC)
+	return int(to.Sub(from).Hours() / 24)
+}
@@ -15,5 +15,5 @@ func initMoscow() *time.Location {
 }
 
 func IsMainFortsSession(d time.Time) bool {
-	return d.Hour() >= 10 && d.Hour() <= 18
+	return SessionAt(MarketForts, d) == SessionMain
 }
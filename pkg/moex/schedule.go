@@ -0,0 +1,281 @@
+package moex
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type Market int
+
+const (
+	MarketForts Market = iota
+	MarketStock
+)
+
+func MarketByClassCode(classCode string) Market {
+	if classCode == FuturesClassCode {
+		return MarketForts
+	}
+	return MarketStock
+}
+
+type Session int
+
+const (
+	// Рынок закрыт: ночь, клиринг, праздник
+	SessionNone Session = iota
+	SessionMorning
+	SessionMain
+	SessionEvening
+	// Торги в выходные дни
+	SessionWeekend
+)
+
+func (s Session) String() string {
+	switch s {
+	case SessionNone:
+		return "none"
+	case SessionMorning:
+		return "morning"
+	case SessionMain:
+		return "main"
+	case SessionEvening:
+		return "evening"
+	case SessionWeekend:
+		return "weekend"
+	default:
+		return "unknown"
+	}
+}
+
+type sessionInterval struct {
+	session Session
+	// от начала дня по Москве
+	start time.Duration
+	end   time.Duration
+}
+
+func hm(hour, minute int) time.Duration {
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute
+}
+
+// Дневной клиринг FORTS 14:00-14:05, вечерний 18:50-19:05.
+var fortsWorkday = []sessionInterval{
+	{SessionMorning, hm(9, 0), hm(10, 0)},
+	{SessionMain, hm(10, 0), hm(14, 0)},
+	{SessionMain, hm(14, 5), hm(18, 50)},
+	{SessionEvening, hm(19, 5), hm(23, 50)},
+}
+
+// Аукцион закрытия фондового рынка 18:40-18:50 считаем частью основной сессии.
+var stockWorkday = []sessionInterval{
+	{SessionMorning, hm(6, 50), hm(9, 50)},
+	{SessionMain, hm(10, 0), hm(18, 50)},
+	{SessionEvening, hm(19, 5), hm(23, 50)},
+}
+
+// Выходные сессии проходят только в дни из календаря.
+var weekend = []sessionInterval{
+	{SessionWeekend, hm(10, 0), hm(19, 0)},
+}
+
+type dayType int
+
+const (
+	dayRegular dayType = iota
+	dayHoliday
+	dayWorkday
+	// выходная сессия на обоих рынках
+	dayWeekend
+	dayWeekendForts
+	dayWeekendStock
+)
+
+//go:embed calendar.csv
+var calendarCsv []byte
+
+var (
+	calendarMu sync.RWMutex
+	calendar   = mustParseCalendar(calendarCsv)
+)
+
+func mustParseCalendar(data []byte) map[string]dayType {
+	var res = make(map[string]dayType)
+	var err = parseCalendar(bytes.NewReader(data), res)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+func parseCalendar(r io.Reader, res map[string]dayType) error {
+	var reader = csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	// первая строка - заголовок
+	for i, record := range records[1:] {
+		if _, err := time.Parse(time.DateOnly, record[0]); err != nil {
+			return fmt.Errorf("line %v: %w", i+2, err)
+		}
+		switch record[1] {
+		case "holiday":
+			res[record[0]] = dayHoliday
+		case "workday":
+			res[record[0]] = dayWorkday
+		case "weekend":
+			res[record[0]] = dayWeekend
+		case "weekend-forts":
+			res[record[0]] = dayWeekendForts
+		case "weekend-stock":
+			res[record[0]] = dayWeekendStock
+		default:
+			return fmt.Errorf("line %v: bad type %v", i+2, record[1])
+		}
+	}
+	return nil
+}
+
+// Добавляет или заменяет дни торгового календаря из csv файла (date,type).
+func LoadCalendar(path string) error {
+	var file, err = os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var days = make(map[string]dayType)
+	if err := parseCalendar(file, days); err != nil {
+		return fmt.Errorf("load %v: %w", path, err)
+	}
+	calendarMu.Lock()
+	defer calendarMu.Unlock()
+	for date, t := range days {
+		calendar[date] = t
+	}
+	return nil
+}
+
+func getDayType(d time.Time) dayType {
+	calendarMu.RLock()
+	defer calendarMu.RUnlock()
+	return calendar[d.Format(time.DateOnly)]
+}
+
+// Рабочий день биржи (без учета выходных сессий).
+func IsBusinessDay(d time.Time) bool {
+	d = d.In(Moscow)
+	switch getDayType(d) {
+	case dayHoliday, dayWeekend, dayWeekendForts, dayWeekendStock:
+		return false
+	case dayWorkday:
+		return true
+	default:
+		return d.Weekday() != time.Saturday && d.Weekday() != time.Sunday
+	}
+}
+
+func daySessions(market Market, d time.Time) []sessionInterval {
+	if IsBusinessDay(d) {
+		if market == MarketForts {
+			return fortsWorkday
+		}
+		return stockWorkday
+	}
+	switch getDayType(d) {
+	case dayWeekend:
+		return weekend
+	case dayWeekendForts:
+		if market == MarketForts {
+			return weekend
+		}
+	case dayWeekendStock:
+		if market == MarketStock {
+			return weekend
+		}
+	}
+	return nil
+}
+
+func startOfDay(d time.Time) time.Time {
+	var y, m, day = d.Date()
+	return time.Date(y, m, day, 0, 0, 0, 0, d.Location())
+}
+
+// Торговая сессия в момент d. SessionNone, если рынок закрыт.
+func SessionAt(market Market, d time.Time) Session {
+	d = d.In(Moscow)
+	var sinceMidnight = d.Sub(startOfDay(d))
+	for _, interval := range daySessions(market, d) {
+		if interval.start <= sinceMidnight && sinceMidnight < interval.end {
+			return interval.session
+		}
+	}
+	return SessionNone
+}
+
+// Начало и конец интервала торгов, в котором находится d.
+// Клиринг разделяет основную сессию FORTS на два интервала.
+func SessionBounds(market Market, d time.Time) (start, end time.Time, ok bool) {
+	d = d.In(Moscow)
+	var day = startOfDay(d)
+	var sinceMidnight = d.Sub(day)
+	for _, interval := range daySessions(market, d) {
+		if interval.start <= sinceMidnight && sinceMidnight < interval.end {
+			return day.Add(interval.start), day.Add(interval.end), true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+func IsMarketOpen(market Market, d time.Time) bool {
+	return SessionAt(market, d) != SessionNone
+}
+
+// Начало следующей сессии после d.
+func NextOpen(market Market, d time.Time) (time.Time, bool) {
+	return findBoundary(market, d, func(interval sessionInterval) time.Duration { return interval.start })
+}
+
+// Конец текущей сессии, если рынок открыт, иначе конец следующей сессии.
+func NextClose(market Market, d time.Time) (time.Time, bool) {
+	return findBoundary(market, d, func(interval sessionInterval) time.Duration { return interval.end })
+}
+
+func findBoundary(
+	market Market,
+	d time.Time,
+	boundary func(sessionInterval) time.Duration,
+) (time.Time, bool) {
+	d = d.In(Moscow)
+	// длинные праздники не превышают пары недель
+	const MaxDays = 30
+	var day = startOfDay(d)
+	for range MaxDays {
+		for _, interval := range daySessions(market, day) {
+			var t = day.Add(boundary(interval))
+			if t.After(d) {
+				return t, true
+			}
+		}
+		day = startOfDay(day.AddDate(0, 0, 1))
+	}
+	return time.Time{}, false
+}
+
+// Бар, открывшийся в момент d, может давать торговый сигнал.
+func IsTradableSession(market Market, d time.Time) bool {
+	return SessionAt(market, d) == SessionMain
+}
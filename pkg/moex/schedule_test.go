@@ -0,0 +1,29 @@
+package moex
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionAtWeekend(t *testing.T) {
+	// суббота с выходной сессией фондового рынка
+	var d = time.Date(2025, 10, 18, 12, 0, 0, 0, Moscow)
+	if session := SessionAt(MarketStock, d); session != SessionWeekend {
+		t.Errorf("stock session = %v", session)
+	}
+	if session := SessionAt(MarketForts, d); session != SessionNone {
+		t.Errorf("forts session = %v", session)
+	}
+	if session := SessionAt(MarketStock, d.Add(8*time.Hour)); session != SessionNone {
+		t.Errorf("stock session after close = %v", session)
+	}
+	if IsBusinessDay(d) {
+		t.Error("weekend session day is not a business day")
+	}
+
+	// перенесенный рабочий день остается рабочим
+	var workday = time.Date(2025, 11, 1, 12, 0, 0, 0, Moscow)
+	if session := SessionAt(MarketStock, workday); session != SessionMain {
+		t.Errorf("workday session = %v", session)
+	}
+}
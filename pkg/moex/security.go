@@ -1,73 +1,235 @@
 package moex
 
 import (
+	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/ChizhovVadim/trader/pkg/brokers"
 )
 
-func GetSecurityInfo(securityName string) (brokers.Security, error) {
-	// квартальные фьючерсы
-	if strings.HasPrefix(securityName, "Si") {
-		securityCode, err := encodeSecurity(securityName)
-		if err != nil {
-			return brokers.Security{}, err
+// Спецификация фьючерса FORTS
+type FuturesSpec struct {
+	// Базовый код в названии инструмента: "Si" для "Si-12.25"
+	Name string `json:"name"`
+	// Краткий код в коде инструмента: "Si" для "SiZ5"
+	Code           string  `json:"code"`
+	PriceStep      float64 `json:"priceStep"`
+	PriceStepCost  float64 `json:"priceStepCost"`
+	Lot            int     `json:"lot"`
+	PricePrecision int     `json:"pricePrecision"`
+	// Если 0, то PriceStepCost/PriceStep
+	Lever float64 `json:"lever"`
+	// Месяцы исполнения через пробел. Если пусто, то квартальные контракты.
+	Months string `json:"months"`
+	// Правило последнего дня торгов, см. ExpirationDate. Если пусто, то "3thu".
+	// "perpetual" - вечный фьючерс без экспирации.
+	Expiration string `json:"expiration"`
+}
+
+//go:embed forts.csv
+var fortsCsv []byte
+
+var (
+	specsMu sync.RWMutex
+	specs   = mustParseSpecs(fortsCsv)
+)
+
+func mustParseSpecs(data []byte) map[string]FuturesSpec {
+	var items, err = parseSpecsCsv(bytes.NewReader(data))
+	if err != nil {
+		panic(err)
+	}
+	var res = make(map[string]FuturesSpec, len(items))
+	for _, item := range items {
+		res[item.Name] = item
+	}
+	return res
+}
+
+// Добавляет или заменяет спецификации из файла пользователя (.json или .csv).
+func LoadSecurityInfo(path string) error {
+	var file, err = os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var items []FuturesSpec
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.NewDecoder(file).Decode(&items)
+	case ".csv":
+		items, err = parseSpecsCsv(file)
+	default:
+		err = fmt.Errorf("unsupported file format %v", path)
+	}
+	if err != nil {
+		return fmt.Errorf("load %v: %w", path, err)
+	}
+	for _, item := range items {
+		if err := validateSpec(item); err != nil {
+			return fmt.Errorf("load %v: %w", path, err)
 		}
-		return brokers.Security{
-			Name:           securityName,
-			ClassCode:      FuturesClassCode,
-			Code:           securityCode,
-			PricePrecision: 0,
-			PriceStep:      1,
-			PriceStepCost:  1,
-			Lever:          1,
-		}, nil
-	}
-	if strings.HasPrefix(securityName, "CNY") {
-		securityCode, err := encodeSecurity(securityName) //CR
-		if err != nil {
-			return brokers.Security{}, err
+	}
+
+	specsMu.Lock()
+	defer specsMu.Unlock()
+	for _, item := range items {
+		specs[item.Name] = item
+	}
+	return nil
+}
+
+func GetFuturesSpec(name string) (FuturesSpec, bool) {
+	specsMu.RLock()
+	defer specsMu.RUnlock()
+	var spec, found = specs[name]
+	return spec, found
+}
+
+func parseSpecsCsv(r io.Reader) ([]FuturesSpec, error) {
+	var reader = csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	// первая строка - заголовок, необязательные колонки можно не указывать
+	var columns = make(map[string]int)
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	for _, name := range []string{"name", "code", "price_step", "price_step_cost", "lot", "price_precision"} {
+		if _, found := columns[name]; !found {
+			return nil, fmt.Errorf("column not found %v", name)
 		}
-		return brokers.Security{
-			Name:           securityName,
-			ClassCode:      FuturesClassCode,
-			Code:           securityCode,
-			PricePrecision: 3,
-			PriceStep:      0.001,
-			PriceStepCost:  1,
-			Lever:          1000,
-		}, nil
-	}
-	return brokers.Security{}, fmt.Errorf("secInfo not found %v", securityName)
+	}
+	var res []FuturesSpec
+	for i, record := range records[1:] {
+		var field = func(name string) string {
+			if index, found := columns[name]; found {
+				return record[index]
+			}
+			return ""
+		}
+		var spec = FuturesSpec{
+			Name:       field("name"),
+			Code:       field("code"),
+			Months:     field("months"),
+			Expiration: field("expiration"),
+		}
+		var errs []error
+		spec.PriceStep, err = strconv.ParseFloat(field("price_step"), 64)
+		errs = append(errs, err)
+		spec.PriceStepCost, err = strconv.ParseFloat(field("price_step_cost"), 64)
+		errs = append(errs, err)
+		spec.Lot, err = strconv.Atoi(field("lot"))
+		errs = append(errs, err)
+		spec.PricePrecision, err = strconv.Atoi(field("price_precision"))
+		errs = append(errs, err)
+		if lever := field("lever"); lever != "" {
+			spec.Lever, err = strconv.ParseFloat(lever, 64)
+			errs = append(errs, err)
+		}
+		if err := errors.Join(errs...); err != nil {
+			return nil, fmt.Errorf("line %v: %w", i+2, err)
+		}
+		if err := validateSpec(spec); err != nil {
+			return nil, fmt.Errorf("line %v: %w", i+2, err)
+		}
+		res = append(res, spec)
+	}
+	return res, nil
+}
+
+func validateSpec(spec FuturesSpec) error {
+	if spec.Name == "" || spec.Code == "" {
+		return errors.New("empty name or code")
+	}
+	if spec.PriceStep <= 0 || spec.PriceStepCost <= 0 {
+		return fmt.Errorf("bad price step %v", spec.Name)
+	}
+	if _, err := parseMonths(spec.Months); err != nil {
+		return fmt.Errorf("bad months %v: %w", spec.Name, err)
+	}
+	if !slices.Contains(expirationRules, spec.Expiration) {
+		return fmt.Errorf("bad expiration %v", spec.Name)
+	}
+	return nil
+}
+
+func GetSecurityInfo(securityName string) (brokers.Security, error) {
+	var spec, found = GetFuturesSpec(baseName(securityName))
+	if !found {
+		return brokers.Security{}, fmt.Errorf("secInfo not found %v", securityName)
+	}
+	securityCode, err := encodeSecurity(spec, securityName)
+	if err != nil {
+		return brokers.Security{}, err
+	}
+	var lever = spec.Lever
+	if lever == 0 {
+		lever = spec.PriceStepCost / spec.PriceStep
+	}
+	return brokers.Security{
+		Name:           securityName,
+		ClassCode:      FuturesClassCode,
+		Code:           securityCode,
+		PricePrecision: spec.PricePrecision,
+		PriceStep:      spec.PriceStep,
+		PriceStepCost:  spec.PriceStepCost,
+		Lever:          lever,
+	}, nil
+}
+
+// Sample: "Si-3.17" -> "Si", "USDRUBF" -> "USDRUBF"
+func baseName(securityName string) string {
+	var name, _, _ = strings.Cut(securityName, "-")
+	return name
 }
 
 // Sample: "Si-3.17" -> "SiH7"
 // http://moex.com/s205
-func encodeSecurity(securityName string) (string, error) {
-	// вечные фьючерсы
-	if strings.HasSuffix(securityName, "F") {
-		return securityName, nil
+func encodeSecurity(spec FuturesSpec, securityName string) (string, error) {
+	if isPerpetual(spec) {
+		if securityName != spec.Name {
+			return "", fmt.Errorf("bad security name %v", securityName)
+		}
+		return spec.Code, nil
 	}
 
 	const MonthCodes = "FGHJKMNQUVXZ"
-	var parts = strings.SplitN(securityName, "-", 2)
-	var name = parts[0]
-	parts = strings.SplitN(parts[1], ".", 2)
-	month, err := strconv.Atoi(parts[0])
+	var _, expiration, found = strings.Cut(securityName, "-")
+	var sMonth, sYear, ok = strings.Cut(expiration, ".")
+	if !found || !ok {
+		return "", fmt.Errorf("bad security name %v", securityName)
+	}
+	month, err := strconv.Atoi(sMonth)
 	if err != nil {
 		return "", err
 	}
-	year, err := strconv.Atoi(parts[1])
+	if month < 1 || month > 12 {
+		return "", fmt.Errorf("bad month %v", securityName)
+	}
+	year, err := strconv.Atoi(sYear)
 	if err != nil {
 		return "", err
 	}
 
-	// курс китайский юань – российский рубль
-	if name == "CNY" {
-		name = "CR"
-	}
-
-	return fmt.Sprintf("%v%v%v", name, string(MonthCodes[month-1]), year%10), nil
+	return fmt.Sprintf("%v%v%v", spec.Code, string(MonthCodes[month-1]), year%10), nil
 }
@@ -0,0 +1,182 @@
+package resample
+
+import (
+	"iter"
+	"log/slog"
+	"sync"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+	"github.com/ChizhovVadim/trader/pkg/moex"
+)
+
+// Источник баров, который подписывается у брокера только на base,
+// а старшие таймфреймы собирает сам и отправляет в callbacks.
+type MarketData struct {
+	logger     *slog.Logger
+	marketData brokers.IMarketData
+	base       brokers.Timeframe
+	// OnCandle вызывается из event loop, который читает callbacks
+	callbacks  *brokers.CallbackQueue
+	mu         sync.Mutex
+	resamplers map[resampleKey]*resampleState
+	// подписки на base по коду инструмента
+	subscribed map[string]bool
+	// сигналы, подписанные на сам base
+	baseSignals map[string]bool
+}
+
+type resampleKey struct {
+	securityCode string
+	timeframe    brokers.Timeframe
+}
+
+type resampleState struct {
+	resampler  *Resampler
+	subscribed bool
+}
+
+var _ brokers.IMarketData = (*MarketData)(nil)
+var _ brokers.ICandleHandler = (*MarketData)(nil)
+
+func NewMarketData(
+	logger *slog.Logger,
+	marketData brokers.IMarketData,
+	base brokers.Timeframe,
+	callbacks chan<- any,
+) *MarketData {
+	return &MarketData{
+		logger:      logger,
+		marketData:  marketData,
+		base:        base,
+		callbacks:   brokers.NewCallbackQueue(callbacks),
+		resamplers:  make(map[resampleKey]*resampleState),
+		subscribed:  make(map[string]bool),
+		baseSignals: make(map[string]bool),
+	}
+}
+
+// Старшие таймфреймы собираются из истории base.
+// Незавершенный последний бар достраивается барами подписки.
+func (m *MarketData) GetLastCandles(security brokers.Security, timeframe brokers.Timeframe) iter.Seq2[brokers.HistoryCandle, error] {
+	if !CanResample(m.base, timeframe) {
+		return m.marketData.GetLastCandles(security, timeframe)
+	}
+	return func(yield func(brokers.HistoryCandle, error) bool) {
+		var resampler, err = New(moex.MarketByClassCode(security.ClassCode), m.base, timeframe)
+		if err != nil {
+			yield(brokers.HistoryCandle{}, err)
+			return
+		}
+		for candle, err := range resampler.Candles(m.marketData.GetLastCandles(security, m.base)) {
+			if !yield(candle, err) || err != nil {
+				return
+			}
+		}
+		var key = resampleKey{security.Code, timeframe}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		var state, found = m.resamplers[key]
+		if found {
+			state.resampler = resampler
+		} else {
+			m.resamplers[key] = &resampleState{resampler: resampler}
+		}
+	}
+}
+
+func (m *MarketData) SubscribeCandles(security brokers.Security, timeframe brokers.Timeframe) error {
+	if !CanResample(m.base, timeframe) {
+		if timeframe == m.base {
+			m.mu.Lock()
+			m.baseSignals[security.Code] = true
+			m.mu.Unlock()
+		}
+		return m.marketData.SubscribeCandles(security, timeframe)
+	}
+	m.mu.Lock()
+	var key = resampleKey{security.Code, timeframe}
+	var state, found = m.resamplers[key]
+	if !found {
+		var resampler, err = New(moex.MarketByClassCode(security.ClassCode), m.base, timeframe)
+		if err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		state = &resampleState{resampler: resampler}
+		m.resamplers[key] = state
+	}
+	state.subscribed = true
+	var alreadySubscribed = m.subscribed[security.Code]
+	m.subscribed[security.Code] = true
+	m.mu.Unlock()
+	if alreadySubscribed {
+		return nil
+	}
+	var err = m.marketData.SubscribeCandles(security, m.base)
+	if err != nil {
+		m.mu.Lock()
+		m.subscribed[security.Code] = false
+		m.mu.Unlock()
+	}
+	return err
+}
+
+// Подписка на base отменяется, когда он больше не нужен ни сигналам, ни старшим таймфреймам.
+func (m *MarketData) UnsubscribeCandles(security brokers.Security, timeframe brokers.Timeframe) error {
+	m.mu.Lock()
+	if timeframe == m.base {
+		delete(m.baseSignals, security.Code)
+	} else if CanResample(m.base, timeframe) {
+		delete(m.resamplers, resampleKey{security.Code, timeframe})
+	} else {
+		m.mu.Unlock()
+		return m.marketData.UnsubscribeCandles(security, timeframe)
+	}
+	var inUse = m.baseSignals[security.Code]
+	for key, state := range m.resamplers {
+		if key.securityCode == security.Code && state.subscribed {
+			inUse = true
+		}
+	}
+	if !inUse {
+		delete(m.subscribed, security.Code)
+	}
+	m.mu.Unlock()
+	if inUse {
+		return nil
+	}
+	return m.marketData.UnsubscribeCandles(security, m.base)
+}
+
+// Собирает бары подписок и отправляет завершенные в callbacks.
+func (m *MarketData) OnCandle(candle brokers.Candle) {
+	if candle.Interval != m.base {
+		return
+	}
+	var msgs []any
+	m.mu.Lock()
+	for key, state := range m.resamplers {
+		if key.securityCode != candle.SecurityCode || !state.subscribed {
+			continue
+		}
+		for _, completed := range state.resampler.Add(candle.HistoryCandle) {
+			msgs = append(msgs, brokers.Candle{
+				Interval:      key.timeframe,
+				SecurityCode:  candle.SecurityCode,
+				HistoryCandle: completed,
+			})
+		}
+	}
+	m.mu.Unlock()
+	if len(msgs) == 0 {
+		return
+	}
+	m.logger.Debug("Resampled candles",
+		"security", candle.SecurityCode,
+		"count", len(msgs))
+	m.callbacks.Publish(msgs...)
+}
+
+func (m *MarketData) Close() error {
+	return m.callbacks.Close()
+}
@@ -0,0 +1,153 @@
+// Сборка баров старшего таймфрейма из баров младшего.
+package resample
+
+import (
+	"fmt"
+	"iter"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+	"github.com/ChizhovVadim/trader/pkg/moex"
+)
+
+// Собирает бары timeframe из баров base.
+// Внутридневные бары выравниваются по часам от полуночи и не переходят границы сессий и клиринга,
+// например, часовой бар FORTS после дневного клиринга начинается в 14:05.
+// Дневные, недельные и месячные бары - по календарным дням, неделям с понедельника и месяцам.
+type Resampler struct {
+	market       moex.Market
+	timeframe    brokers.Timeframe
+	baseDuration time.Duration
+	current      brokers.HistoryCandle
+	currentEnd   time.Time
+	hasCurrent   bool
+	last         time.Time
+	completed    []brokers.HistoryCandle
+}
+
+// Можно ли собрать бары timeframe из баров base.
+func CanResample(base, timeframe brokers.Timeframe) bool {
+	var baseDuration = base.Duration()
+	if baseDuration == 0 || base == timeframe {
+		return false
+	}
+	switch timeframe {
+	case brokers.TimeframeD1, brokers.TimeframeW1, brokers.TimeframeMN:
+		return baseDuration < 24*time.Hour
+	}
+	var duration = timeframe.Duration()
+	return duration > baseDuration && duration%baseDuration == 0
+}
+
+func New(market moex.Market, base, timeframe brokers.Timeframe) (*Resampler, error) {
+	if !CanResample(base, timeframe) {
+		return nil, fmt.Errorf("cannot resample %v to %v", base, timeframe)
+	}
+	return &Resampler{
+		market:       market,
+		timeframe:    timeframe,
+		baseDuration: base.Duration(),
+		completed:    make([]brokers.HistoryCandle, 0, 2),
+	}, nil
+}
+
+// Добавляет бар base и возвращает завершенные бары timeframe.
+// Результат действителен до следующего вызова.
+// Повторы и бары не по порядку пропускаются.
+func (r *Resampler) Add(candle brokers.HistoryCandle) []brokers.HistoryCandle {
+	r.completed = r.completed[:0]
+	if !r.last.IsZero() && !candle.DateTime.After(r.last) {
+		return r.completed
+	}
+	r.last = candle.DateTime
+	var start, end = r.bucket(candle.DateTime)
+	if r.hasCurrent && !start.Equal(r.current.DateTime) {
+		// последний бар интервала не пришел
+		r.completed = append(r.completed, r.current)
+		r.hasCurrent = false
+	}
+	if !r.hasCurrent {
+		r.current = candle
+		r.current.DateTime = start
+		r.currentEnd = end
+		r.hasCurrent = true
+	} else {
+		r.current.HighPrice = max(r.current.HighPrice, candle.HighPrice)
+		r.current.LowPrice = min(r.current.LowPrice, candle.LowPrice)
+		r.current.ClosePrice = candle.ClosePrice
+		r.current.Volume += candle.Volume
+	}
+	if r.isComplete(candle.DateTime.Add(r.baseDuration)) {
+		r.completed = append(r.completed, r.current)
+		r.hasCurrent = false
+	}
+	return r.completed
+}
+
+// Возвращает незавершенный бар, например, в конце истории.
+func (r *Resampler) Flush() (brokers.HistoryCandle, bool) {
+	if !r.hasCurrent {
+		return brokers.HistoryCandle{}, false
+	}
+	r.hasCurrent = false
+	return r.current, true
+}
+
+// Завершенные бары timeframe из истории баров base.
+// Незавершенный последний бар не возвращается, его можно получить через Flush.
+func (r *Resampler) Candles(candles iter.Seq2[brokers.HistoryCandle, error]) iter.Seq2[brokers.HistoryCandle, error] {
+	return func(yield func(brokers.HistoryCandle, error) bool) {
+		for candle, err := range candles {
+			if err != nil {
+				yield(brokers.HistoryCandle{}, err)
+				return
+			}
+			for _, completed := range r.Add(candle) {
+				if !yield(completed, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Интервал бара timeframe, в который попадает момент d.
+func (r *Resampler) bucket(d time.Time) (start, end time.Time) {
+	d = d.In(moex.Moscow)
+	var y, m, day = d.Date()
+	var midnight = time.Date(y, m, day, 0, 0, 0, 0, moex.Moscow)
+	switch r.timeframe {
+	case brokers.TimeframeD1:
+		return midnight, midnight.AddDate(0, 0, 1)
+	case brokers.TimeframeW1:
+		var monday = midnight.AddDate(0, 0, -(int(d.Weekday())+6)%7)
+		return monday, monday.AddDate(0, 0, 7)
+	case brokers.TimeframeMN:
+		var first = time.Date(y, m, 1, 0, 0, 0, 0, moex.Moscow)
+		return first, first.AddDate(0, 1, 0)
+	}
+	var duration = r.timeframe.Duration()
+	start = midnight.Add(d.Sub(midnight).Truncate(duration))
+	end = start.Add(duration)
+	if sessionStart, sessionEnd, ok := moex.SessionBounds(r.market, d); ok {
+		if sessionStart.After(start) {
+			start = sessionStart
+		}
+		if sessionEnd.Before(end) {
+			end = sessionEnd
+		}
+	}
+	return start, end
+}
+
+// Бар завершен, если до его конца торгов больше не будет.
+func (r *Resampler) isComplete(baseEnd time.Time) bool {
+	if !baseEnd.Before(r.currentEnd) {
+		return true
+	}
+	if moex.IsMarketOpen(r.market, baseEnd) {
+		return false
+	}
+	var nextOpen, ok = moex.NextOpen(r.market, baseEnd)
+	return !ok || !nextOpen.Before(r.currentEnd)
+}
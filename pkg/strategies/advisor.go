@@ -0,0 +1,63 @@
+package strategies
+
+import (
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+)
+
+// Позволяет использовать советник-функцию в SignalService.
+// Пока советник не готов (ok=false), сигнал не формируется.
+func NewAdvisorIndicator(advisor Advisor) Indicator {
+	return &advisorIndicator{advisor: advisor}
+}
+
+type advisorIndicator struct {
+	advisor Advisor
+	value   float64
+}
+
+func (ind *advisorIndicator) Add(d time.Time, value float64) bool {
+	var prediction, ok = ind.advisor(d, value)
+	if ok {
+		ind.value = prediction
+	}
+	return ok
+}
+
+func (ind *advisorIndicator) Value() float64 {
+	return ind.value
+}
+
+// Позволяет использовать советник по барам OHLCV в SignalService.
+func NewCandleAdvisorIndicator(advisor CandleAdvisor) CandleIndicator {
+	return &candleAdvisorIndicator{advisor: advisor}
+}
+
+type candleAdvisorIndicator struct {
+	advisor CandleAdvisor
+	value   float64
+}
+
+func (ind *candleAdvisorIndicator) AddCandle(candle brokers.HistoryCandle) bool {
+	var prediction, ok = ind.advisor(candle)
+	if ok {
+		ind.value = prediction
+	}
+	return ok
+}
+
+// Если известна только цена закрытия, то считаем бар без диапазона.
+func (ind *candleAdvisorIndicator) Add(d time.Time, value float64) bool {
+	return ind.AddCandle(brokers.HistoryCandle{
+		DateTime:   d,
+		OpenPrice:  value,
+		HighPrice:  value,
+		LowPrice:   value,
+		ClosePrice: value,
+	})
+}
+
+func (ind *candleAdvisorIndicator) Value() float64 {
+	return ind.value
+}
@@ -0,0 +1,235 @@
+package strategies
+
+import (
+	"iter"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+)
+
+type BacktestTrade struct {
+	DateTime   time.Time
+	Volume     int
+	Price      float64
+	Commission float64
+}
+
+type EquityPoint struct {
+	DateTime time.Time
+	Equity   float64
+}
+
+type BacktestStats struct {
+	StartEquity float64
+	FinalEquity float64
+	TotalReturn float64
+	// Максимальная просадка от пика, доля
+	MaxDrawdown float64
+	// Годовой коэффициент Шарпа по дневным доходностям
+	Sharpe     float64
+	Trades     int
+	Commission float64
+}
+
+type BacktestResult struct {
+	// Капитал на закрытии каждого торгового дня
+	Equity []EquityPoint
+	Trades []BacktestTrade
+	Stats  BacktestStats
+}
+
+// Тестирование на истории.
+// Бары проходят через те же SignalService, StrategyService и PortfolioService, что и в торговле,
+// а заявки исполняет brokers.MockBroker, как в бумажной торговле, с модельным временем.
+// Каждый торговый день моделируется как новый запуск робота:
+// доступная сумма портфеля читается из лимитов брокера, базовая цена сигнала сбрасывается.
+type Backtest struct {
+	logger         *slog.Logger
+	security       brokers.Security
+	candleInterval brokers.Timeframe
+	// каждый запуск начинается с нового индикатора
+	newIndicator func() (Indicator, error)
+	sizeConfig   SizeConfig
+	brokerConfig brokers.MockBrokerConfig
+}
+
+// Начальный капитал - brokerConfig.StartAmount.
+// Заявки исполняются по барам candleInterval.
+func NewBacktest(
+	logger *slog.Logger,
+	security brokers.Security,
+	candleInterval brokers.Timeframe,
+	newIndicator func() (Indicator, error),
+	sizeConfig SizeConfig,
+	brokerConfig brokers.MockBrokerConfig,
+) *Backtest {
+	brokerConfig.FillTimeframe = candleInterval
+	return &Backtest{
+		logger:         logger,
+		security:       security,
+		candleInterval: candleInterval,
+		newIndicator:   newIndicator,
+		sizeConfig:     sizeConfig,
+		brokerConfig:   brokerConfig,
+	}
+}
+
+// Бары до start только прогревают индикатор.
+func (b *Backtest) Run(
+	start time.Time,
+	candles iter.Seq2[brokers.HistoryCandle, error],
+) (BacktestResult, error) {
+	var ind, err = b.newIndicator()
+	if err != nil {
+		return BacktestResult{}, err
+	}
+
+	var now time.Time
+	var clock = func() time.Time { return now }
+
+	// без callbacks: состояния заявок и сделки забираем сами после каждого шага
+	var broker = brokers.NewBufferedMockBroker(b.logger, "backtest", b.brokerConfig)
+	defer broker.Close()
+	var portfolio = &Portfolio{Portfolio: brokers.Portfolio{Client: "backtest", Portfolio: "backtest"}}
+	var portfolioService = NewPortfolioService(b.logger, broker, portfolio, 0, 0)
+	var signal = NewSignalService(b.logger, "backtest", nil, b.security, b.candleInterval, ind, b.sizeConfig)
+	signal.start = start
+	var strategy = NewStrategyService(b.logger, broker, portfolio, b.security, signal.name)
+	strategy.clock = clock
+	strategy.plannedPosition.SetValue(0)
+
+	var (
+		result  BacktestResult
+		lastDay time.Time
+	)
+	var deliver = func() {
+		for _, msg := range broker.Drain() {
+			switch msg := msg.(type) {
+			case brokers.OrderState:
+				strategy.OnOrder(msg)
+			case brokers.Trade:
+				result.Trades = append(result.Trades, BacktestTrade{
+					DateTime:   msg.DateTime,
+					Volume:     msg.Volume,
+					Price:      msg.Price,
+					Commission: (b.brokerConfig.ExchangeFee + b.brokerConfig.BrokerFee) * math.Abs(float64(msg.Volume)),
+				})
+			}
+		}
+	}
+	var equity = func() (float64, error) {
+		var limits, err = broker.GetPortfolioLimits(portfolio.Portfolio)
+		if err != nil {
+			return 0, err
+		}
+		return limits.StartLimitOpenPos + limits.AccVarMargin + limits.VarMargin, nil
+	}
+	var addEquityPoint = func(day time.Time) error {
+		var value, err = equity()
+		if err != nil {
+			return err
+		}
+		result.Equity = append(result.Equity, EquityPoint{DateTime: day, Equity: value})
+		return nil
+	}
+
+	for candle, err := range candles {
+		if err != nil {
+			return BacktestResult{}, err
+		}
+		now = candle.DateTime
+		if candle.DateTime.Before(start) {
+			signal.addHistoryCandle(candle)
+			continue
+		}
+
+		var day = truncateDay(candle.DateTime)
+		if !day.Equal(lastDay) {
+			if !lastDay.IsZero() {
+				if err := addEquityPoint(lastDay); err != nil {
+					return BacktestResult{}, err
+				}
+			}
+			lastDay = day
+			// новый запуск робота
+			if err := portfolioService.InitLimits(); err != nil {
+				return BacktestResult{}, err
+			}
+			signal.resetState()
+		}
+
+		var brokerCandle = brokers.Candle{
+			Interval:      b.candleInterval,
+			SecurityCode:  b.security.Code,
+			HistoryCandle: candle,
+		}
+		// заявки прошлых баров исполняются по ценам текущего
+		broker.OnCandle(brokerCandle)
+		deliver()
+		var newSignal = signal.OnCandle(brokerCandle)
+		if newSignal.DateTime.IsZero() {
+			continue
+		}
+		strategy.OnSignal(newSignal)
+		deliver()
+	}
+	if !lastDay.IsZero() {
+		if err := addEquityPoint(lastDay); err != nil {
+			return BacktestResult{}, err
+		}
+	}
+	result.Stats = computeBacktestStats(b.brokerConfig.StartAmount, result)
+	return result, nil
+}
+
+func truncateDay(d time.Time) time.Time {
+	var y, m, day = d.Date()
+	return time.Date(y, m, day, 0, 0, 0, 0, d.Location())
+}
+
+func computeBacktestStats(startEquity float64, result BacktestResult) BacktestStats {
+	var stats = BacktestStats{
+		StartEquity: startEquity,
+		FinalEquity: startEquity,
+		Trades:      len(result.Trades),
+	}
+	for _, trade := range result.Trades {
+		stats.Commission += trade.Commission
+	}
+	if len(result.Equity) == 0 || startEquity == 0 {
+		return stats
+	}
+	stats.FinalEquity = result.Equity[len(result.Equity)-1].Equity
+	stats.TotalReturn = stats.FinalEquity/startEquity - 1
+
+	var (
+		peak    = startEquity
+		prev    = startEquity
+		sum     float64
+		sumSq   float64
+		returns int
+	)
+	for _, point := range result.Equity {
+		peak = max(peak, point.Equity)
+		if peak > 0 {
+			stats.MaxDrawdown = max(stats.MaxDrawdown, 1-point.Equity/peak)
+		}
+		if prev > 0 {
+			var ret = point.Equity/prev - 1
+			sum += ret
+			sumSq += ret * ret
+			returns += 1
+		}
+		prev = point.Equity
+	}
+	if returns > 1 {
+		var mean = sum / float64(returns)
+		var variance = (sumSq - float64(returns)*mean*mean) / float64(returns-1)
+		if variance > 0 {
+			stats.Sharpe = mean / math.Sqrt(variance) * math.Sqrt(TradingDaysPerYear)
+		}
+	}
+	return stats
+}
@@ -1,6 +1,7 @@
 package strategies
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/ChizhovVadim/trader/pkg/brokers"
@@ -11,8 +12,18 @@ type Indicator interface {
 	Value() float64
 }
 
+// Индикатор, которому нужен весь бар, а не только цена закрытия.
+// SignalService передает такому индикатору бары целиком.
+type CandleIndicator interface {
+	Indicator
+	AddCandle(candle brokers.HistoryCandle) bool
+}
+
 type Advisor func(dateTime time.Time, closePrice float64) (prediction float64, ok bool)
 
+// Советник по барам OHLCV.
+type CandleAdvisor func(candle brokers.HistoryCandle) (prediction float64, ok bool)
+
 type Optional[T any] struct {
 	Value    T
 	HasValue bool
@@ -28,9 +39,55 @@ type Portfolio struct {
 	AmountAvailable Optional[float64]
 }
 
+// Что делать, если плановая позиция стратегии расходится с позицией у брокера.
+type ReconcilePolicy int
+
+const (
+	// Только предупреждение: стратегия не торгует, пока расхождение не устранят вручную
+	ReconcileAlert ReconcilePolicy = iota
+	// Принять позицию брокера как плановую
+	ReconcileAdopt
+	// Выставить заявку, возвращающую позицию у брокера к плановой
+	ReconcileCorrect
+)
+
+func (p ReconcilePolicy) String() string {
+	switch p {
+	case ReconcileAlert:
+		return "alert"
+	case ReconcileAdopt:
+		return "adopt"
+	case ReconcileCorrect:
+		return "correct"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseReconcilePolicy(s string) (ReconcilePolicy, error) {
+	for _, policy := range []ReconcilePolicy{ReconcileAlert, ReconcileAdopt, ReconcileCorrect} {
+		if policy.String() == s {
+			return policy, nil
+		}
+	}
+	return ReconcileAlert, fmt.Errorf("bad reconcile policy %v", s)
+}
+
+type ReconcileConfig struct {
+	Policy ReconcilePolicy
+	// Расхождение устраняется, только если держится дольше GracePeriod:
+	// callbacks по сделкам могут запаздывать.
+	GracePeriod time.Duration
+}
+
 type SizeConfig struct {
 	LongLever  float64 `xml:",attr"`
 	ShortLever float64 `xml:",attr"`
 	MaxLever   float64 `xml:",attr"`
 	Weight     float64 `xml:",attr"`
+	// Целевая годовая волатильность позиции, например, 0.2. 0 - не использовать.
+	// Тогда плечо LongLever/ShortLever заменяется на TargetVolatility/волатильность инструмента.
+	TargetVolatility float64 `xml:",attr"`
+	// Число дней для оценки волатильности инструмента по дневным доходностям, не меньше 2. 0 - 20 дней.
+	VolatilityLookback int `xml:",attr"`
 }
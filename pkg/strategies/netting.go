@@ -0,0 +1,444 @@
+package strategies
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strconv"
+	"sync"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+)
+
+// Сводит заявки нескольких стратегий одного портфеля в одну заявку по каждому инструменту.
+// Каждая стратегия торгует через виртуального брокера (NewMember), который хранит ее собственную позицию.
+// Встречные заявки стратегий исполняются внутри без отправки брокеру,
+// а остаток отправляется одной заявкой, исполнение которой распределяется между стратегиями.
+// Накопленные заявки отправляются в Flush.
+type PositionAggregator struct {
+	logger    *slog.Logger
+	broker    brokers.IBroker
+	portfolio brokers.Portfolio
+	// заявки регистрируются из того же event loop, который читает callbacks
+	callbacks *brokers.CallbackQueue
+	mu        sync.Mutex
+	store     StateStore
+	members   []*nettingMember
+	orderId   int
+	// виртуальные заявки, еще не отправленные брокеру
+	pending []*virtualOrder
+	// незавершенные виртуальные заявки
+	virtualOrders map[string]*virtualOrder
+	securities    map[string]brokers.Security
+	// заявки у брокера
+	orders map[string]*nettingOrder
+}
+
+type nettingMember struct {
+	aggregator *PositionAggregator
+	name       string
+	// виртуальные позиции по коду инструмента
+	positions map[string]int
+}
+
+type virtualOrder struct {
+	member *nettingMember
+	state  brokers.OrderState
+	// заявка у брокера, в которую вошла виртуальная заявка
+	brokerOrderId string
+}
+
+type nettingOrder struct {
+	// виртуальные заявки в порядке распределения исполнения
+	allocations []*virtualOrder
+	// уже распределенный исполненный объем
+	allocated int
+}
+
+var _ brokers.IBroker = (*nettingMember)(nil)
+
+func NewPositionAggregator(
+	logger *slog.Logger,
+	broker brokers.IBroker,
+	portfolio brokers.Portfolio,
+	callbacks chan<- any,
+) *PositionAggregator {
+	logger = logger.With(
+		"client", portfolio.Client,
+		"portfolio", portfolio.Portfolio,
+		"type", "netting")
+	return &PositionAggregator{
+		logger:        logger,
+		broker:        broker,
+		portfolio:     portfolio,
+		callbacks:     brokers.NewCallbackQueue(callbacks),
+		virtualOrders: make(map[string]*virtualOrder),
+		securities:    make(map[string]brokers.Security),
+		orders:        make(map[string]*nettingOrder),
+	}
+}
+
+// Виртуальный брокер для стратегии. name должен быть уникальным в портфеле.
+func (a *PositionAggregator) NewMember(name string) brokers.IBroker {
+	var member = &nettingMember{
+		aggregator: a,
+		name:       name,
+		positions:  make(map[string]int),
+	}
+	a.members = append(a.members, member)
+	return member
+}
+
+func (a *PositionAggregator) CheckStatus() {
+	a.mu.Lock()
+	var totals = make(map[string]int)
+	for _, member := range a.members {
+		for code, position := range member.positions {
+			totals[code] += position
+		}
+	}
+	var securities = maps.Clone(a.securities)
+	var activeOrders = len(a.orders)
+	a.mu.Unlock()
+
+	for code, total := range totals {
+		brokerPos, err := a.broker.GetPosition(a.portfolio, securities[code])
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		var status = "+"
+		if int(brokerPos) != total {
+			status = fmt.Sprintf("! actual: %v", int(brokerPos))
+		}
+		fmt.Printf("%10v %10v %10v netted: %6v %v\n",
+			a.portfolio.Client,
+			a.portfolio.Portfolio,
+			securities[code].Name,
+			total,
+			status)
+	}
+	fmt.Printf("%10v %10v netting orders: %v\n", a.portfolio.Client, a.portfolio.Portfolio, activeOrders)
+}
+
+// Отправляет брокеру накопленные заявки стратегий.
+// Возвращает true, если была зарегистрирована заявка у брокера.
+func (a *PositionAggregator) Flush() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.pending) == 0 {
+		return false
+	}
+	var pending = a.pending
+	a.pending = nil
+
+	var codes []string
+	var groups = make(map[string][]*virtualOrder)
+	for _, order := range pending {
+		var code = order.state.Order.Security.Code
+		if _, found := groups[code]; !found {
+			codes = append(codes, code)
+		}
+		groups[code] = append(groups[code], order)
+	}
+	var orderRegistered bool
+	var changed []brokers.OrderState
+	for _, code := range codes {
+		var registered bool
+		registered, changed = a.flushSecurity(groups[code], changed)
+		if registered {
+			orderRegistered = true
+		}
+	}
+	a.publish(changed)
+	return orderRegistered
+}
+
+func (a *PositionAggregator) flushSecurity(orders []*virtualOrder, changed []brokers.OrderState) (bool, []brokers.OrderState) {
+	var net, gross int
+	for _, order := range orders {
+		net += order.state.Order.Volume
+		gross += abs(order.state.Order.Volume)
+	}
+	// объем встречных заявок, который исполняется внутри
+	var crossed = (gross - abs(net)) / 2
+	var netOrders []*virtualOrder
+	for _, order := range orders {
+		if net == 0 || sign(order.state.Order.Volume) != sign(net) {
+			a.fill(order, order.state.Order.Volume)
+			changed = append(changed, order.state)
+			continue
+		}
+		var volume = min(crossed, abs(order.state.Order.Volume))
+		crossed -= volume
+		if volume != 0 {
+			a.fill(order, volume*sign(net))
+			changed = append(changed, order.state)
+		}
+		if !order.state.IsFinal() {
+			netOrders = append(netOrders, order)
+		}
+	}
+	if net == 0 {
+		a.logger.Info("Orders netted",
+			"security", orders[0].state.Order.Security.Name,
+			"orders", len(orders))
+		return false, changed
+	}
+
+	var price = netOrders[0].state.Order.Price
+	for _, order := range netOrders {
+		// самая агрессивная цена, чтобы заявка исполнилась для всех стратегий
+		if net > 0 {
+			price = max(price, order.state.Order.Price)
+		} else {
+			price = min(price, order.state.Order.Price)
+		}
+	}
+	var order = brokers.Order{
+		Portfolio: a.portfolio,
+		Security:  netOrders[0].state.Order.Security,
+		Volume:    net,
+		Price:     price,
+	}
+	orderId, err := a.broker.RegisterOrder(order)
+	if err != nil {
+		a.logger.Warn("RegisterOrder failed",
+			"security", order.Security.Name,
+			"volume", net,
+			"error", err)
+		for _, virtual := range netOrders {
+			a.finish(virtual, brokers.OrderStatusRejected, err.Error())
+			changed = append(changed, virtual.state)
+		}
+		return false, changed
+	}
+	a.logger.Info("Netted order registered",
+		"security", order.Security.Name,
+		"volume", net,
+		"price", price,
+		"orders", len(orders),
+		"orderId", orderId)
+	for _, virtual := range netOrders {
+		virtual.brokerOrderId = orderId
+	}
+	a.orders[orderId] = &nettingOrder{allocations: netOrders}
+	return true, changed
+}
+
+// Распределяет исполнение заявки брокера по виртуальным заявкам стратегий.
+// Возвращает false, если это не заявка агрегатора.
+func (a *PositionAggregator) OnOrder(state brokers.OrderState) bool {
+	if state.Order.Portfolio != a.portfolio {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var order, found = a.orders[state.Id]
+	if !found {
+		return false
+	}
+	var changed []brokers.OrderState
+	var volume = abs(state.FilledVolume) - order.allocated
+	for _, virtual := range order.allocations {
+		if volume <= 0 {
+			break
+		}
+		var remaining = abs(virtual.state.Order.Volume - virtual.state.FilledVolume)
+		var filled = min(volume, remaining)
+		if filled == 0 {
+			continue
+		}
+		volume -= filled
+		order.allocated += filled
+		a.fill(virtual, filled*sign(virtual.state.Order.Volume))
+		changed = append(changed, virtual.state)
+	}
+	if state.IsFinal() {
+		delete(a.orders, state.Id)
+		for _, virtual := range order.allocations {
+			if !virtual.state.IsFinal() {
+				a.finish(virtual, state.Status, state.Reason)
+				changed = append(changed, virtual.state)
+			}
+		}
+	}
+	a.publish(changed)
+	return true
+}
+
+// Сверка заявок после восстановления соединения с брокером.
+func (a *PositionAggregator) Reconcile() {
+	a.mu.Lock()
+	var orderIds = make([]string, 0, len(a.orders))
+	for orderId := range a.orders {
+		orderIds = append(orderIds, orderId)
+	}
+	a.mu.Unlock()
+	for _, orderId := range orderIds {
+		state, err := a.broker.GetOrder(a.portfolio, orderId)
+		if err != nil {
+			a.logger.Warn("GetOrder failed",
+				"orderId", orderId,
+				"error", err)
+			continue
+		}
+		a.OnOrder(state)
+	}
+}
+
+func (a *PositionAggregator) fill(order *virtualOrder, volume int) {
+	var code = order.state.Order.Security.Code
+	order.member.positions[code] += volume
+	order.state.FilledVolume += volume
+	if order.state.FilledVolume == order.state.Order.Volume {
+		order.state.Status = brokers.OrderStatusFilled
+		delete(a.virtualOrders, order.state.Id)
+	} else {
+		order.state.Status = brokers.OrderStatusPartiallyFilled
+	}
+	a.saveState(order.member, code)
+}
+
+// Завершенная заявка больше не нужна: ее состояние стратегия получит через callbacks.
+func (a *PositionAggregator) finish(order *virtualOrder, status brokers.OrderStatus, reason string) {
+	order.state.Status = status
+	order.state.Reason = reason
+	delete(a.virtualOrders, order.state.Id)
+}
+
+func (a *PositionAggregator) stateKey(member *nettingMember, securityCode string) string {
+	return "netting/" + a.portfolio.Client + "/" + a.portfolio.Portfolio + "/" + member.name + "/" + securityCode
+}
+
+// Виртуальные позиции у брокера не хранятся, поэтому сохраняются без ограничения по дате.
+func (a *PositionAggregator) saveState(member *nettingMember, securityCode string) {
+	if a.store == nil {
+		return
+	}
+	var err = a.store.Save(a.stateKey(member, securityCode), member.positions[securityCode])
+	if err != nil {
+		a.logger.Warn("Save state failed",
+			"error", err)
+	}
+}
+
+func (a *PositionAggregator) position(member *nettingMember, security brokers.Security) (int, error) {
+	if position, found := member.positions[security.Code]; found {
+		return position, nil
+	}
+	var position int
+	if a.store != nil {
+		var _, err = a.store.Load(a.stateKey(member, security.Code), &position)
+		if err != nil {
+			return 0, err
+		}
+	}
+	member.positions[security.Code] = position
+	a.securities[security.Code] = security
+	return position, nil
+}
+
+func (a *PositionAggregator) publish(states []brokers.OrderState) {
+	for _, state := range states {
+		a.callbacks.Publish(state)
+	}
+}
+
+func (a *PositionAggregator) Close() error {
+	return a.callbacks.Close()
+}
+
+func (m *nettingMember) Init(context.Context) error { return nil }
+func (m *nettingMember) CheckStatus()               {}
+func (m *nettingMember) Close() error               { return nil }
+
+func (m *nettingMember) GetPortfolioLimits(portfolio brokers.Portfolio) (brokers.PortfolioLimits, error) {
+	return m.aggregator.broker.GetPortfolioLimits(portfolio)
+}
+
+func (m *nettingMember) GetPosition(portfolio brokers.Portfolio, security brokers.Security) (float64, error) {
+	var a = m.aggregator
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var position, err = a.position(m, security)
+	return float64(position), err
+}
+
+func (m *nettingMember) RegisterOrder(order brokers.Order) (string, error) {
+	var a = m.aggregator
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if order.Portfolio != a.portfolio {
+		return "", fmt.Errorf("bad portfolio %v", order.Portfolio.Portfolio)
+	}
+	if _, err := a.position(m, order.Security); err != nil {
+		return "", err
+	}
+	a.orderId += 1
+	var virtual = &virtualOrder{
+		member: m,
+		state: brokers.OrderState{
+			Id:     "net-" + strconv.Itoa(a.orderId),
+			Order:  order,
+			Status: brokers.OrderStatusNew,
+		},
+	}
+	a.virtualOrders[virtual.state.Id] = virtual
+	a.pending = append(a.pending, virtual)
+	return virtual.state.Id, nil
+}
+
+// Снятие виртуальной заявки, уже отправленной брокеру, снимает всю сводную заявку.
+func (m *nettingMember) CancelOrder(portfolio brokers.Portfolio, orderId string) error {
+	var a = m.aggregator
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var virtual, found = a.virtualOrders[orderId]
+	if !found || virtual.member != m {
+		return fmt.Errorf("order not found %v", orderId)
+	}
+	if virtual.state.IsFinal() {
+		return fmt.Errorf("order is not active %v", orderId)
+	}
+	if virtual.brokerOrderId != "" {
+		return a.broker.CancelOrder(a.portfolio, virtual.brokerOrderId)
+	}
+	for i, order := range a.pending {
+		if order == virtual {
+			a.pending = append(a.pending[:i], a.pending[i+1:]...)
+			break
+		}
+	}
+	a.finish(virtual, brokers.OrderStatusCancelled, "")
+	a.publish([]brokers.OrderState{virtual.state})
+	return nil
+}
+
+func (m *nettingMember) GetOrder(portfolio brokers.Portfolio, orderId string) (brokers.OrderState, error) {
+	var a = m.aggregator
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if virtual, found := a.virtualOrders[orderId]; found && virtual.member == m {
+		return virtual.state, nil
+	}
+	return brokers.OrderState{}, fmt.Errorf("order not found %v", orderId)
+}
+
+func sign(x int) int {
+	if x > 0 {
+		return 1
+	}
+	if x < 0 {
+		return -1
+	}
+	return 0
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
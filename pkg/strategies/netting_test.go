@@ -0,0 +1,49 @@
+package strategies
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+	"github.com/ChizhovVadim/trader/pkg/moex"
+)
+
+// Завершенные виртуальные заявки не накапливаются в агрегаторе.
+func TestPositionAggregatorForgetsFinalOrders(t *testing.T) {
+	var logger = slog.New(slog.DiscardHandler)
+	var broker = brokers.NewMockBroker(logger, "mock", brokers.MockBrokerConfig{}, nil)
+	defer broker.Close()
+	var portfolio = brokers.Portfolio{Client: "mock", Firm: "firm", Portfolio: "acc"}
+	var security = brokers.Security{Name: "Si-12.25", Code: "SiZ5", ClassCode: moex.FuturesClassCode, PriceStep: 1, PriceStepCost: 1, Lever: 1}
+	var aggregator = NewPositionAggregator(logger, broker, portfolio, nil)
+	defer aggregator.Close()
+	var first = aggregator.NewMember("first")
+	var second = aggregator.NewMember("second")
+
+	// встречные заявки исполняются внутри
+	for _, order := range []struct {
+		member brokers.IBroker
+		volume int
+	}{{first, 2}, {second, -2}} {
+		if _, err := order.member.RegisterOrder(brokers.Order{Portfolio: portfolio, Security: security, Volume: order.volume, Price: 90_000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if aggregator.Flush() {
+		t.Error("crossed orders must not reach the broker")
+	}
+	if position, _ := first.GetPosition(portfolio, security); position != 2 {
+		t.Errorf("first position = %v", position)
+	}
+
+	orderId, err := first.RegisterOrder(brokers.Order{Portfolio: portfolio, Security: security, Volume: 1, Price: 90_000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.CancelOrder(portfolio, orderId); err != nil {
+		t.Fatal(err)
+	}
+	if len(aggregator.virtualOrders) != 0 {
+		t.Errorf("virtual orders = %v", len(aggregator.virtualOrders))
+	}
+}
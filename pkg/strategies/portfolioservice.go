@@ -13,6 +13,7 @@ type PortfolioService struct {
 	portfolio *Portfolio
 	maxAmount float64
 	weight    float64
+	store     StateStore
 }
 
 func NewPortfolioService(
@@ -34,7 +35,28 @@ func NewPortfolioService(
 	}
 }
 
+func (s *PortfolioService) stateKey() string {
+	return "portfolio/" + s.portfolio.Portfolio.Client + "/" + s.portfolio.Portfolio.Portfolio
+}
+
+// После перезапуска в течение дня доступная сумма восстанавливается из хранилища.
 func (s *PortfolioService) Init() error {
+	var amount, found, err = loadState[float64](s.store, s.stateKey())
+	if err != nil {
+		s.logger.Warn("Load state failed",
+			"error", err)
+	}
+	if found {
+		s.logger.Info("Init portfolio from state",
+			"availableAmount", amount)
+		s.portfolio.AmountAvailable.SetValue(amount)
+		return nil
+	}
+	return s.InitLimits()
+}
+
+// Читает лимиты у брокера, например, после ввода/вывода средств.
+func (s *PortfolioService) InitLimits() error {
 	var limits, err = s.broker.GetPortfolioLimits(s.portfolio.Portfolio)
 	if err != nil {
 		return err
@@ -50,9 +72,18 @@ func (s *PortfolioService) Init() error {
 		"amount", limits.StartLimitOpenPos,
 		"availableAmount", availableAmount)
 	s.portfolio.AmountAvailable.SetValue(availableAmount)
+	s.saveState()
 	return nil
 }
 
+func (s *PortfolioService) saveState() {
+	var err = saveState(s.store, s.stateKey(), s.portfolio.AmountAvailable.Value)
+	if err != nil {
+		s.logger.Warn("Save state failed",
+			"error", err)
+	}
+}
+
 func (s *PortfolioService) CheckStatus() {
 	var limits, err = s.broker.GetPortfolioLimits(s.portfolio.Portfolio)
 	if err != nil {
@@ -0,0 +1,167 @@
+package strategies
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+)
+
+type ParamType int
+
+const (
+	ParamFloat ParamType = iota
+	ParamInt
+	ParamString
+)
+
+func (t ParamType) String() string {
+	switch t {
+	case ParamFloat:
+		return "float"
+	case ParamInt:
+		return "int"
+	case ParamString:
+		return "string"
+	default:
+		return "unknown"
+	}
+}
+
+type AdvisorParam struct {
+	Name string
+	Type ParamType
+	// Значение по умолчанию. Если пустое, то числовой параметр обязателен.
+	Default     string
+	Description string
+}
+
+// Советник, который можно выбрать по имени из конфигурации.
+type AdvisorFactory struct {
+	Name   string
+	Params []AdvisorParam
+	New    func(params AdvisorParams) (Indicator, error)
+}
+
+// Проверенные значения параметров советника.
+type AdvisorParams struct {
+	values map[string]any
+}
+
+func (p AdvisorParams) Float(name string) float64 {
+	var value, _ = p.values[name].(float64)
+	return value
+}
+
+func (p AdvisorParams) Int(name string) int {
+	var value, _ = p.values[name].(int)
+	return value
+}
+
+func (p AdvisorParams) String(name string) string {
+	var value, _ = p.values[name].(string)
+	return value
+}
+
+var (
+	advisorsMu sync.RWMutex
+	advisors   = make(map[string]AdvisorFactory)
+)
+
+// Регистрирует советник, обычно в init пакета советника.
+func RegisterAdvisor(factory AdvisorFactory) {
+	advisorsMu.Lock()
+	defer advisorsMu.Unlock()
+	if factory.New == nil {
+		panic("strategies: RegisterAdvisor factory is nil " + factory.Name)
+	}
+	if _, found := advisors[factory.Name]; found {
+		panic("strategies: RegisterAdvisor called twice for " + factory.Name)
+	}
+	advisors[factory.Name] = factory
+}
+
+// Зарегистрированные советники в порядке имен.
+func Advisors() []AdvisorFactory {
+	advisorsMu.RLock()
+	defer advisorsMu.RUnlock()
+	var res = make([]AdvisorFactory, 0, len(advisors))
+	for _, factory := range advisors {
+		res = append(res, factory)
+	}
+	slices.SortFunc(res, func(a, b AdvisorFactory) int { return strings.Compare(a.Name, b.Name) })
+	return res
+}
+
+// Создает советник по имени. params - значения параметров из конфигурации.
+func NewAdvisor(name string, params map[string]string) (Indicator, error) {
+	advisorsMu.RLock()
+	var factory, found = advisors[name]
+	advisorsMu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("advisor not found %v", name)
+	}
+	for paramName := range params {
+		if !slices.ContainsFunc(factory.Params, func(p AdvisorParam) bool { return p.Name == paramName }) {
+			return nil, fmt.Errorf("advisor %v: unknown param %v", name, paramName)
+		}
+	}
+	var values = make(map[string]any)
+	var description []string
+	for _, param := range factory.Params {
+		var s, found = params[param.Name]
+		if !found {
+			s = param.Default
+		}
+		var value, err = parseParam(param, s)
+		if err != nil {
+			return nil, fmt.Errorf("advisor %v: param %v: %w", name, param.Name, err)
+		}
+		values[param.Name] = value
+		description = append(description, param.Name+"="+s)
+	}
+	ind, err := factory.New(AdvisorParams{values: values})
+	if err != nil {
+		return nil, fmt.Errorf("advisor %v: %w", name, err)
+	}
+	return &registeredAdvisor{
+		Indicator:   ind,
+		description: name + "(" + strings.Join(description, " ") + ")",
+	}, nil
+}
+
+func parseParam(param AdvisorParam, s string) (any, error) {
+	if s == "" && param.Type != ParamString {
+		return nil, fmt.Errorf("required %v", param.Type)
+	}
+	switch param.Type {
+	case ParamFloat:
+		return strconv.ParseFloat(s, 64)
+	case ParamInt:
+		return strconv.Atoi(s)
+	case ParamString:
+		return s, nil
+	default:
+		return nil, fmt.Errorf("bad param type %v", param.Type)
+	}
+}
+
+// Советник из реестра помнит имя и параметры, чтобы CheckStatus мог их показать.
+type registeredAdvisor struct {
+	Indicator
+	description string
+}
+
+func (a *registeredAdvisor) AddCandle(candle brokers.HistoryCandle) bool {
+	if ind, ok := a.Indicator.(CandleIndicator); ok {
+		return ind.AddCandle(candle)
+	}
+	return a.Indicator.Add(candle.DateTime, candle.ClosePrice)
+}
+
+func (a *registeredAdvisor) String() string {
+	return a.description
+}
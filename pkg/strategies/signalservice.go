@@ -21,16 +21,20 @@ type Signal struct {
 }
 
 type SignalService struct {
+	// без атрибута инструмента, который меняется при rollover
+	parentLogger   *slog.Logger
 	logger         *slog.Logger
 	name           string
 	marketData     brokers.IMarketData
 	security       brokers.Security
-	candleInterval string
+	candleInterval brokers.Timeframe
 	ind            Indicator
 	sizeConfig     SizeConfig
+	volatility     *dailyVolatility
 	start          time.Time
 	baseCandle     brokers.Candle
 	lastSignal     Signal
+	store          StateStore
 }
 
 func NewSignalService(
@@ -38,26 +42,53 @@ func NewSignalService(
 	name string,
 	marketData brokers.IMarketData,
 	security brokers.Security,
-	candleInterval string,
+	candleInterval brokers.Timeframe,
 	ind Indicator,
 	sizeConfig SizeConfig,
 ) *SignalService {
-	logger = logger.With(
-		"name", name,
-		"security", security.Name)
-	return &SignalService{
-		logger:         logger,
+	var volatility *dailyVolatility
+	if sizeConfig.TargetVolatility != 0 {
+		volatility = newDailyVolatility(sizeConfig.VolatilityLookback)
+	}
+	var s = &SignalService{
+		parentLogger:   logger,
 		name:           name,
 		marketData:     marketData,
-		security:       security,
 		candleInterval: candleInterval,
 		ind:            ind,
 		sizeConfig:     sizeConfig,
+		volatility:     volatility,
 		start:          time.Now().Add(-10 * time.Minute),
 	}
+	s.setSecurity(security)
+	return s
+}
+
+func (s *SignalService) setSecurity(security brokers.Security) {
+	s.security = security
+	s.logger = s.parentLogger.With(
+		"name", s.name,
+		"security", security.Name)
 }
 
+func (s *SignalService) stateKey() string {
+	return "signal/" + s.name + "/" + s.security.Code
+}
+
+// Базовая цена восстанавливается из хранилища,
+// чтобы перезапуск в течение дня не менял размер позиции.
 func (s *SignalService) Init() error {
+	var baseCandle, found, err = loadState[brokers.Candle](s.store, s.stateKey())
+	if err != nil {
+		s.logger.Warn("Load state failed",
+			"error", err)
+	}
+	if found {
+		s.baseCandle = baseCandle
+		s.logger.Info("Init base price from state",
+			"DateTime", s.baseCandle.DateTime,
+			"Price", s.baseCandle.ClosePrice)
+	}
 	if err := s.AddHistoryCandles(s.marketData.GetLastCandles(s.security, s.candleInterval)); err != nil {
 		return err
 	}
@@ -66,17 +97,64 @@ func (s *SignalService) Init() error {
 		"Price", s.lastSignal.Price,
 		"Prediction", s.lastSignal.Prediction,
 	)
+	s.subscribe()
+	return nil
+}
+
+func (s *SignalService) subscribe() {
+	s.resubscribe(brokers.Security{})
+}
+
+// Отменяет подписку old (если задан) и подписывается на текущий инструмент.
+func (s *SignalService) resubscribe(old brokers.Security) {
+	var security = s.security
+	var logger = s.logger
 	// тк можем подписаться на несколько инструментов,
 	// то подписываемся в отдельной горутине,
 	// чтобы сразу начать читать бары из первой подписки и не заблокироваться.
 	go func() {
-		var err = s.marketData.SubscribeCandles(s.security, s.candleInterval)
+		if old.Code != "" {
+			var err = s.marketData.UnsubscribeCandles(old, s.candleInterval)
+			if err != nil {
+				logger.Warn("marketData.UnsubscribeCandles",
+					"security", old.Name,
+					"error", err)
+			}
+		}
+		var err = s.marketData.SubscribeCandles(security, s.candleInterval)
 		if err != nil {
-			s.logger.Error("marketData.SubscribeCandles", "error", err)
+			logger.Error("marketData.SubscribeCandles", "error", err)
 			return
 		}
 	}()
-	return nil
+}
+
+// Переход на следующий контракт.
+// Индикатор сохраняется, чтобы история сигнала оставалась непрерывной.
+// Базовая цена будет взята с первого бара нового контракта.
+func (s *SignalService) rollover(security brokers.Security) {
+	s.logger.Info("Rollover signal",
+		"from", s.security.Name,
+		"to", security.Name)
+	var old = s.security
+	s.setSecurity(security)
+	s.lastSignal = Signal{}
+	s.resetState()
+	s.saveState()
+	s.resubscribe(old)
+}
+
+func (s *SignalService) saveState() {
+	var err = saveState(s.store, s.stateKey(), s.baseCandle)
+	if err != nil {
+		s.logger.Warn("Save state failed",
+			"error", err)
+	}
+}
+
+// Базовая цена будет взята с первого нового бара.
+func (s *SignalService) resetState() {
+	s.baseCandle = brokers.Candle{}
 }
 
 func (s *SignalService) CheckStatus() {
@@ -87,19 +165,29 @@ func (s *SignalService) CheckStatus() {
 		s.lastSignal.Price,
 		s.lastSignal.Prediction,
 	)
+	if advisor, ok := s.ind.(fmt.Stringer); ok {
+		fmt.Printf("%10v advisor: %v\n", "", advisor)
+	}
+	if s.volatility != nil {
+		if volatility, ok := s.volatility.value(); ok {
+			fmt.Printf("%10v volatility: %.1f%% target: %.1f%%\n", "",
+				volatility*100, s.sizeConfig.TargetVolatility*100)
+		} else {
+			fmt.Printf("%10v volatility: not enough history\n", "")
+		}
+	}
 }
 
 func (s *SignalService) OnCandle(candle brokers.Candle) Signal {
 	// советник следит только за своими барами
-	if !( /*TODO s.candleInterval == candle.Interval &&*/
-	s.security.Code == candle.SecurityCode) {
+	if !(s.candleInterval == candle.Interval &&
+		s.security.Code == candle.SecurityCode) {
 		return Signal{}
 	}
-	if !s.ind.Add(candle.DateTime, candle.ClosePrice) {
+	if !s.addCandle(candle.HistoryCandle) {
 		return Signal{}
 	}
-	// пока так
-	if !moex.IsMainFortsSession(candle.DateTime) {
+	if !moex.IsTradableSession(moex.MarketByClassCode(s.security.ClassCode), candle.DateTime) {
 		return Signal{}
 	}
 	var freshCandle = candle.DateTime.After(s.start)
@@ -108,6 +196,7 @@ func (s *SignalService) OnCandle(candle brokers.Candle) Signal {
 		s.logger.Debug("Init base price",
 			"DateTime", s.baseCandle.DateTime,
 			"Price", s.baseCandle.ClosePrice)
+		s.saveState()
 	}
 	s.lastSignal = s.makeSignal(candle.DateTime, candle.ClosePrice)
 	if freshCandle {
@@ -126,13 +215,26 @@ func (s *SignalService) makeSignal(dt time.Time, price float64) Signal {
 		Prediction:   s.ind.Value(),
 	}
 	if !s.baseCandle.DateTime.IsZero() {
-		var position = applySize(signal.Prediction, s.sizeConfig)
-		signal.ContractsPerAmount.SetValue(position / (s.baseCandle.ClosePrice * s.security.Lever))
-		signal.Deadline = dt.Add(9 * time.Minute) // от открытия бара или 4 минуты от закрытия.
+		if position, ok := s.positionSize(signal.Prediction); ok {
+			signal.ContractsPerAmount.SetValue(position / (s.baseCandle.ClosePrice * s.security.Lever))
+			signal.Deadline = dt.Add(9 * time.Minute) // от открытия бара или 4 минуты от закрытия.
+		}
 	}
 	return signal
 }
 
+// Пока волатильность не оценена, размер позиции не определен и стратегии не торгуют.
+func (s *SignalService) positionSize(prediction float64) (float64, bool) {
+	if s.volatility == nil {
+		return applySize(prediction, s.sizeConfig), true
+	}
+	var volatility, ok = s.volatility.value()
+	if !ok || volatility == 0 {
+		return 0, false
+	}
+	return applyVolatilitySize(prediction, s.sizeConfig, volatility), true
+}
+
 func (s *SignalService) AddHistoryCandles(historyCandles iter.Seq2[brokers.HistoryCandle, error]) error {
 	var (
 		firstCandle brokers.HistoryCandle
@@ -150,9 +252,7 @@ func (s *SignalService) AddHistoryCandles(historyCandles iter.Seq2[brokers.Histo
 		lastCandle = candle
 		size += 1
 
-		if s.ind.Add(candle.DateTime, candle.ClosePrice) {
-			s.lastSignal = s.makeSignal(candle.DateTime, candle.ClosePrice)
-		}
+		s.addHistoryCandle(candle)
 	}
 	if size == 0 {
 		s.logger.Warn("History candles empty")
@@ -165,6 +265,23 @@ func (s *SignalService) AddHistoryCandles(historyCandles iter.Seq2[brokers.Histo
 	return nil
 }
 
+func (s *SignalService) addHistoryCandle(candle brokers.HistoryCandle) {
+	if s.addCandle(candle) {
+		s.lastSignal = s.makeSignal(candle.DateTime, candle.ClosePrice)
+	}
+}
+
+// Индикаторам, которым нужен весь бар, передаем бар целиком.
+func (s *SignalService) addCandle(candle brokers.HistoryCandle) bool {
+	if s.volatility != nil {
+		s.volatility.add(candle)
+	}
+	if ind, ok := s.ind.(CandleIndicator); ok {
+		return ind.AddCandle(candle)
+	}
+	return s.ind.Add(candle.DateTime, candle.ClosePrice)
+}
+
 func applySize(pos float64, config SizeConfig) float64 {
 	if pos > 0 {
 		pos *= config.LongLever
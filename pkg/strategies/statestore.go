@@ -0,0 +1,145 @@
+package strategies
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/moex"
+)
+
+// Хранилище состояния робота между перезапусками.
+type StateStore interface {
+	Load(key string, value any) (bool, error)
+	Save(key string, value any) error
+	Reset() error
+}
+
+// Состояние в json файле. Файл перезаписывается целиком при каждом сохранении.
+type FileStateStore struct {
+	path   string
+	mu     sync.Mutex
+	loaded bool
+	data   map[string]json.RawMessage
+}
+
+var _ StateStore = (*FileStateStore)(nil)
+
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{
+		path: path,
+		data: make(map[string]json.RawMessage),
+	}
+}
+
+func (s *FileStateStore) Load(key string, value any) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	var data, found = s.data[key]
+	if !found {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return false, fmt.Errorf("state %v: %w", key, err)
+	}
+	return true, nil
+}
+
+func (s *FileStateStore) Save(key string, value any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	var data, err = json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.data[key] = data
+	return s.write()
+}
+
+func (s *FileStateStore) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loaded = true
+	s.data = make(map[string]json.RawMessage)
+	var err = os.Remove(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileStateStore) load() error {
+	if s.loaded {
+		return nil
+	}
+	var content, err = os.ReadFile(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			s.loaded = true
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(content, &s.data); err != nil {
+		return fmt.Errorf("load %v: %w", s.path, err)
+	}
+	s.loaded = true
+	return nil
+}
+
+// Пишем во временный файл и переименовываем, чтобы при сбое не остался обрезанный файл.
+func (s *FileStateStore) write() error {
+	var content, err = json.MarshalIndent(s.data, "", "\t")
+	if err != nil {
+		return err
+	}
+	var tmp = s.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Снимок действует только в тот день, когда был сделан:
+// на следующий день робот начинает с чистого состояния.
+type stateSnapshot[T any] struct {
+	Date  string
+	Value T
+}
+
+func stateDate() string {
+	return time.Now().In(moex.Moscow).Format(time.DateOnly)
+}
+
+func saveState[T any](store StateStore, key string, value T) error {
+	if store == nil {
+		return nil
+	}
+	return store.Save(key, stateSnapshot[T]{Date: stateDate(), Value: value})
+}
+
+func loadState[T any](store StateStore, key string) (T, bool, error) {
+	var snapshot stateSnapshot[T]
+	if store == nil {
+		return snapshot.Value, false, nil
+	}
+	var found, err = store.Load(key, &snapshot)
+	if err != nil || !found || snapshot.Date != stateDate() {
+		var zero T
+		return zero, false, err
+	}
+	return snapshot.Value, true, nil
+}
@@ -9,12 +9,24 @@ import (
 )
 
 type StrategyService struct {
+	// без атрибута инструмента, который меняется при rollover
+	parentLogger    *slog.Logger
 	logger          *slog.Logger
 	broker          brokers.IBroker
 	portfolio       *Portfolio
 	security        brokers.Security
 	signalName      string
 	plannedPosition Optional[int]
+	stopped         bool
+	rollingOver     bool
+	activeOrders    map[string]brokers.OrderState
+	store           StateStore
+	reconcile       ReconcileConfig
+	// заявки, исправляющие расхождение, не меняют плановую позицию
+	correctiveOrders map[string]bool
+	divergedSince    time.Time
+	// в тестировании на истории время модельное
+	clock func() time.Time
 }
 
 func NewStrategyService(
@@ -24,33 +36,98 @@ func NewStrategyService(
 	security brokers.Security,
 	signalName string,
 ) *StrategyService {
-	logger = logger.With(
-		"client", portfolio.Portfolio.Client,
-		"portfolio", portfolio.Portfolio.Portfolio,
-		"security", security.Name,
-		"signal", signalName)
-	return &StrategyService{
-		logger:     logger,
-		broker:     broker,
-		portfolio:  portfolio,
-		security:   security,
-		signalName: signalName,
+	var s = &StrategyService{
+		parentLogger:     logger,
+		broker:           broker,
+		portfolio:        portfolio,
+		signalName:       signalName,
+		activeOrders:     make(map[string]brokers.OrderState),
+		correctiveOrders: make(map[string]bool),
+		clock:            time.Now,
 	}
+	s.setSecurity(security)
+	return s
+}
+
+func (s *StrategyService) setSecurity(security brokers.Security) {
+	s.security = security
+	s.logger = s.parentLogger.With(
+		"client", s.portfolio.Portfolio.Client,
+		"portfolio", s.portfolio.Portfolio.Portfolio,
+		"security", security.Name,
+		"signal", s.signalName)
 }
 
 func (s *StrategyService) getBrokerPos() (float64, error) {
 	return s.broker.GetPosition(s.portfolio.Portfolio, s.security)
 }
 
-func (s *StrategyService) Init() error {
+func (s *StrategyService) stateKey() string {
+	return "strategy/" + s.portfolio.Portfolio.Client + "/" + s.portfolio.Portfolio.Portfolio +
+		"/" + s.security.Code + "/" + s.signalName
+}
+
+// Состояние стратегии между перезапусками в течение дня.
+type strategyState struct {
+	PlannedPosition int
+	// после closeall стратегия не торгует до rebalance
+	Stopped bool
+}
+
+// Плановая позиция и остановка восстанавливаются из хранилища.
+// Если она расходится с позицией у брокера, то стратегия не торгует, пока расхождение не будет устранено.
+// Позицию у брокера запрашивает Trader.init для всех стратегий сразу.
+func (s *StrategyService) initPosition(brokerPos float64) {
+	state, found, err := loadState[strategyState](s.store, s.stateKey())
+	if err != nil {
+		s.logger.Warn("Load state failed",
+			"error", err)
+	}
+	if !found {
+		s.plannedPosition.SetValue(int(brokerPos))
+		s.saveState()
+		s.logger.Info("Init strategy",
+			"Position", s.plannedPosition.Value)
+		return
+	}
+	s.plannedPosition.SetValue(state.PlannedPosition)
+	s.stopped = state.Stopped
+	s.logger.Info("Init strategy from state",
+		"Position", s.plannedPosition.Value,
+		"Stopped", s.stopped)
+	if state.PlannedPosition != int(brokerPos) {
+		s.logger.Warn("Position diverged",
+			"planned", state.PlannedPosition,
+			"actual", int(brokerPos))
+	}
+}
+
+func (s *StrategyService) saveState() {
+	if !s.plannedPosition.HasValue {
+		return
+	}
+	var err = saveState(s.store, s.stateKey(), strategyState{
+		PlannedPosition: s.plannedPosition.Value,
+		Stopped:         s.stopped,
+	})
+	if err != nil {
+		s.logger.Warn("Save state failed",
+			"error", err)
+	}
+}
+
+// Плановая позиция заново читается у брокера.
+func (s *StrategyService) resetState() {
 	brokerPos, err := s.getBrokerPos()
 	if err != nil {
-		return err
+		s.logger.Warn("Reset state failed",
+			"error", err)
+		return
 	}
 	s.plannedPosition.SetValue(int(brokerPos))
-	s.logger.Info("Init strategy",
+	s.saveState()
+	s.logger.Info("Reset strategy",
 		"Position", s.plannedPosition.Value)
-	return nil
 }
 
 func (s *StrategyService) CheckStatus() {
@@ -64,6 +141,12 @@ func (s *StrategyService) CheckStatus() {
 	} else {
 		status = "!"
 	}
+	if s.stopped {
+		status += " stopped"
+	}
+	if !s.divergedSince.IsZero() {
+		status += " diverged since " + s.divergedSince.Format("15:04")
+	}
 	fmt.Printf("%10v %10v %10v planned: %6v actual: %6v %v\n",
 		s.portfolio.Portfolio.Client,
 		s.portfolio.Portfolio.Portfolio,
@@ -71,6 +154,154 @@ func (s *StrategyService) CheckStatus() {
 		s.plannedPosition.Value,
 		int(brokerPos),
 		status)
+	for orderId := range s.activeOrders {
+		order, err := s.broker.GetOrder(s.portfolio.Portfolio, orderId)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("%10v order: %v volume: %6v filled: %6v %v\n",
+			"",
+			order.Id,
+			order.Order.Volume,
+			order.FilledVolume,
+			order.Status)
+		// брокер не публикует состояние, прочитанное через GetOrder
+		s.OnOrder(order)
+	}
+}
+
+// Сверка с брокером после восстановления соединения:
+// за время обрыва callbacks по заявкам могли потеряться.
+func (s *StrategyService) Reconcile() {
+	for orderId := range s.activeOrders {
+		state, err := s.broker.GetOrder(s.portfolio.Portfolio, orderId)
+		if err != nil {
+			s.logger.Warn("GetOrder failed",
+				"orderId", orderId,
+				"error", err)
+			continue
+		}
+		s.OnOrder(state)
+	}
+	brokerPos, err := s.getBrokerPos()
+	if err != nil {
+		s.logger.Warn("Reconcile failed",
+			"error", err)
+		return
+	}
+	if !s.plannedPosition.HasValue {
+		return
+	}
+	if len(s.activeOrders) != 0 {
+		if s.plannedPosition.Value != int(brokerPos) {
+			s.logger.Warn("Position diverged",
+				"planned", s.plannedPosition.Value,
+				"actual", int(brokerPos),
+				"activeOrders", len(s.activeOrders))
+		}
+		return
+	}
+	s.observeDivergence(int(brokerPos))
+}
+
+// Отслеживает начало и конец расхождения плановой позиции с позицией у брокера.
+func (s *StrategyService) observeDivergence(brokerPos int) bool {
+	if s.plannedPosition.Value == brokerPos {
+		if !s.divergedSince.IsZero() {
+			s.divergedSince = time.Time{}
+			s.logger.Info("Position divergence resolved",
+				"Position", brokerPos)
+		}
+		return false
+	}
+	if s.divergedSince.IsZero() {
+		s.divergedSince = s.clock()
+		s.logger.Warn("Position diverged",
+			"planned", s.plannedPosition.Value,
+			"actual", brokerPos,
+			"policy", s.reconcile.Policy)
+	}
+	return true
+}
+
+// Устраняет расхождение по политике стратегии.
+// Возвращает true, если после этого позицию можно менять.
+func (s *StrategyService) resolveDivergence(brokerPos int, price float64, orderRegistered *bool) (bool, error) {
+	if s.reconcile.Policy == ReconcileAlert ||
+		s.clock().Sub(s.divergedSince) < s.reconcile.GracePeriod {
+		return false, nil
+	}
+	switch s.reconcile.Policy {
+	case ReconcileAdopt:
+		s.logger.Warn("Position divergence resolved",
+			"action", "adopt",
+			"planned", s.plannedPosition.Value,
+			"actual", brokerPos)
+		s.plannedPosition.SetValue(brokerPos)
+		s.saveState()
+		s.divergedSince = time.Time{}
+		return true, nil
+	case ReconcileCorrect:
+		if price == 0 {
+			return false, fmt.Errorf("price not found")
+		}
+		var volume = s.plannedPosition.Value - brokerPos
+		orderId, err := s.registerOrder(volume, price)
+		if err != nil {
+			return false, err
+		}
+		s.correctiveOrders[orderId] = true
+		s.divergedSince = time.Time{}
+		*orderRegistered = true
+		s.logger.Warn("Position divergence resolved",
+			"action", "correct",
+			"planned", s.plannedPosition.Value,
+			"actual", brokerPos,
+			"orderId", orderId)
+		return false, nil
+	default:
+		return false, nil
+	}
+}
+
+// Изменение состояния заявки.
+// Если заявка отвергнута или снята, то неисполненный объем вычитаем из плановой позиции.
+func (s *StrategyService) OnOrder(state brokers.OrderState) {
+	if state.Order.Portfolio != s.portfolio.Portfolio {
+		return
+	}
+	if _, found := s.activeOrders[state.Id]; !found {
+		return
+	}
+	if !state.IsFinal() {
+		s.activeOrders[state.Id] = state
+		return
+	}
+	delete(s.activeOrders, state.Id)
+	if s.correctiveOrders[state.Id] {
+		delete(s.correctiveOrders, state.Id)
+		s.logger.Info("Corrective order finished",
+			"orderId", state.Id,
+			"status", state.Status,
+			"filled", state.FilledVolume)
+		return
+	}
+	if state.Status == brokers.OrderStatusFilled {
+		s.logger.Debug("Order filled",
+			"orderId", state.Id,
+			"volume", state.FilledVolume)
+		return
+	}
+	var unfilled = state.Order.Volume - state.FilledVolume
+	s.plannedPosition.Value -= unfilled
+	s.saveState()
+	s.logger.Warn("Order not filled",
+		"orderId", state.Id,
+		"status", state.Status,
+		"reason", state.Reason,
+		"unfilled", unfilled,
+		"Position", s.plannedPosition.Value)
 }
 
 func (s *StrategyService) OnSignal(signal Signal) bool {
@@ -83,14 +314,63 @@ func (s *StrategyService) OnSignal(signal Signal) bool {
 	return orderRegistered
 }
 
+// Принудительная ребалансировка к последнему сигналу, не дожидаясь следующего бара.
+// Снимает остановку после ClosePosition.
+func (s *StrategyService) Rebalance(signal Signal) bool {
+	if !s.isOwnSignal(signal) {
+		return false
+	}
+	if s.stopped {
+		s.stopped = false
+		s.saveState()
+	}
+	var orderRegistered bool
+	var err = s.rebalance_impl(signal, &orderRegistered)
+	if err != nil {
+		s.logger.Warn("Rebalance failed",
+			"error", err)
+	}
+	return orderRegistered
+}
+
+// Закрывает позицию по цене последнего сигнала.
+// Стратегия не открывает новых позиций до команды Rebalance.
+func (s *StrategyService) ClosePosition(signal Signal) bool {
+	if !s.isOwnSignal(signal) {
+		return false
+	}
+	if !s.stopped {
+		s.stopped = true
+		s.saveState()
+	}
+	var orderRegistered bool
+	var err = s.changePosition(0, signal.Price, &orderRegistered)
+	if err != nil {
+		s.logger.Warn("ClosePosition failed",
+			"error", err)
+	}
+	return orderRegistered
+}
+
+func (s *StrategyService) isOwnSignal(signal Signal) bool {
+	return signal.SecurityCode == s.security.Code &&
+		signal.Name == s.signalName
+}
+
 func (s *StrategyService) on_signal_impl(signal Signal, orderRegistered *bool) error {
 	// стратегия следит только за своими сигналами
-	if !(signal.SecurityCode == s.security.Code &&
-		signal.Name == s.signalName) {
+	if !s.isOwnSignal(signal) {
 		return nil
 	}
 	// считаем, что сигнал слишком старый
-	if signal.Deadline.Before(time.Now()) {
+	if signal.Deadline.Before(s.clock()) {
+		return nil
+	}
+	return s.rebalance_impl(signal, orderRegistered)
+}
+
+func (s *StrategyService) rebalance_impl(signal Signal, orderRegistered *bool) error {
+	if s.stopped || s.rollingOver {
 		return nil
 	}
 	if !s.portfolio.AmountAvailable.HasValue {
@@ -99,36 +379,143 @@ func (s *StrategyService) on_signal_impl(signal Signal, orderRegistered *bool) e
 	if !signal.ContractsPerAmount.HasValue {
 		return nil
 	}
+	var idealPos = signal.ContractsPerAmount.Value * s.portfolio.AmountAvailable.Value
+	return s.changePosition(idealPos, signal.Price, orderRegistered)
+}
+
+func (s *StrategyService) changePosition(idealPos float64, price float64, orderRegistered *bool) error {
 	if !s.plannedPosition.HasValue {
 		return nil
 	}
-	var idealPos = signal.ContractsPerAmount.Value * s.portfolio.AmountAvailable.Value
 	var volume = int(idealPos - float64(s.plannedPosition.Value))
 	// изменение позиции не требуется
 	if volume == 0 {
 		return nil
 	}
+	if len(s.activeOrders) != 0 {
+		// Предыдущая заявка не исполнилась. Снимаем ее, позиция изменится на следующем сигнале.
+		s.cancelActiveOrders()
+		return fmt.Errorf("active orders found")
+	}
+	// позицию у брокера проверяем только перед отправкой заявки
 	brokerPos, err := s.getBrokerPos()
 	if err != nil {
 		return err
 	}
-	if s.plannedPosition.Value != int(brokerPos) {
-		return fmt.Errorf("check position failed")
+	if s.observeDivergence(int(brokerPos)) {
+		resolved, err := s.resolveDivergence(int(brokerPos), price, orderRegistered)
+		if err != nil {
+			return err
+		}
+		if !resolved {
+			// корректирующая заявка отправлена, позиция изменится на следующем сигнале
+			if len(s.activeOrders) != 0 {
+				return nil
+			}
+			return fmt.Errorf("check position failed")
+		}
+		volume = int(idealPos - float64(s.plannedPosition.Value))
+		if volume == 0 {
+			return nil
+		}
 	}
-	err = s.broker.RegisterOrder(brokers.Order{
-		Portfolio: s.portfolio.Portfolio,
-		Security:  s.security,
-		Volume:    volume,
-		Price:     priceWithSlippage(signal.Price, volume),
-	})
-	if err != nil {
+	if price == 0 {
+		return fmt.Errorf("price not found")
+	}
+	if _, err := s.registerOrder(volume, price); err != nil {
 		return err
 	}
 	s.plannedPosition.Value += volume
+	s.saveState()
 	*orderRegistered = true
 	return nil
 }
 
+func (s *StrategyService) registerOrder(volume int, price float64) (string, error) {
+	var order = brokers.Order{
+		Portfolio: s.portfolio.Portfolio,
+		Security:  s.security,
+		Volume:    volume,
+		Price:     priceWithSlippage(price, volume),
+	}
+	orderId, err := s.broker.RegisterOrder(order)
+	if err != nil {
+		return "", err
+	}
+	s.activeOrders[orderId] = brokers.OrderState{
+		Id:     orderId,
+		Order:  order,
+		Status: brokers.OrderStatusNew,
+	}
+	return orderId, nil
+}
+
+func (s *StrategyService) isSignalStrategy(signal *SignalService) bool {
+	return s.signalName == signal.name &&
+		s.security.Code == signal.security.Code
+}
+
+// Закрывает позицию в истекающем контракте и не открывает новых до rollover.
+// Возвращает true, когда позиция закрыта и можно переходить на следующий контракт.
+func (s *StrategyService) closeForRollover(lastSignal Signal, orderRegistered *bool) bool {
+	if !s.rollingOver {
+		s.rollingOver = true
+		s.logger.Info("Rollover started")
+	}
+	if !s.plannedPosition.HasValue {
+		return false
+	}
+	if s.plannedPosition.Value != 0 {
+		var err = s.changePosition(0, lastSignal.Price, orderRegistered)
+		if err != nil {
+			s.logger.Warn("Rollover close failed",
+				"error", err)
+		}
+		return false
+	}
+	if len(s.activeOrders) != 0 {
+		return false
+	}
+	brokerPos, err := s.getBrokerPos()
+	if err != nil {
+		s.logger.Warn("Rollover close failed",
+			"error", err)
+		return false
+	}
+	return brokerPos == 0
+}
+
+// Переход на следующий контракт. Позиция откроется на следующем сигнале.
+func (s *StrategyService) rollover(security brokers.Security) {
+	var oldSecurity = s.security
+	s.setSecurity(security)
+	brokerPos, err := s.getBrokerPos()
+	if err != nil {
+		s.logger.Warn("Rollover failed",
+			"error", err)
+		s.plannedPosition = Optional[int]{}
+	} else {
+		s.plannedPosition.SetValue(int(brokerPos))
+		s.saveState()
+	}
+	s.rollingOver = false
+	s.logger.Info("Rollover finished",
+		"from", oldSecurity.Name,
+		"to", security.Name,
+		"Position", s.plannedPosition.Value)
+}
+
+func (s *StrategyService) cancelActiveOrders() {
+	for orderId := range s.activeOrders {
+		var err = s.broker.CancelOrder(s.portfolio.Portfolio, orderId)
+		if err != nil {
+			s.logger.Warn("CancelOrder failed",
+				"orderId", orderId,
+				"error", err)
+		}
+	}
+}
+
 func priceWithSlippage(price float64, volume int) float64 {
 	const Slippage = 0.001
 	if volume > 0 {
@@ -0,0 +1,123 @@
+package strategies
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+	"github.com/ChizhovVadim/trader/pkg/brokers/quik"
+	"github.com/ChizhovVadim/trader/pkg/connectors/quikemulator"
+	"github.com/ChizhovVadim/trader/pkg/moex"
+)
+
+// Заявка исполнилась, пока callbacks не доходили:
+// CheckStatus узнает состояние у QUIK и передает его стратегии.
+func TestStrategyCheckStatusRecoversOrder(t *testing.T) {
+	var server = quikemulator.New(nil)
+	if err := server.Start(0); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetAutoFill(false)
+
+	var logger = slog.New(slog.DiscardHandler)
+	// без callbacks: OnOrder от QUIK до стратегии не дойдет
+	var broker = quik.NewQuikBroker(logger, "quik", server.Port(), nil)
+	if err := broker.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	var security = brokers.Security{Name: "Si-12.25", Code: "SiZ5", ClassCode: moex.FuturesClassCode, PriceStep: 1, PriceStepCost: 1, Lever: 1}
+	var portfolio = &Portfolio{Portfolio: brokers.Portfolio{Client: "quik", Firm: "firm", Portfolio: "acc"}}
+	var strategy = NewStrategyService(logger, broker, portfolio, security, "signal")
+	strategy.plannedPosition.SetValue(0)
+	if _, err := strategy.registerOrder(2, 90_000); err != nil {
+		t.Fatal(err)
+	}
+	strategy.plannedPosition.Value += 2
+
+	var deadline = time.Now().Add(5 * time.Second)
+	for len(strategy.activeOrders) != 0 && time.Now().Before(deadline) {
+		server.FillOrders()
+		strategy.CheckStatus()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(strategy.activeOrders) != 0 {
+		t.Fatalf("active orders = %v", strategy.activeOrders)
+	}
+	if strategy.plannedPosition.Value != 2 {
+		t.Errorf("planned position = %v", strategy.plannedPosition.Value)
+	}
+}
+
+// Остановка после closeall переживает перезапуск в течение дня.
+func TestStrategyStoppedRestoredFromState(t *testing.T) {
+	var logger = slog.New(slog.DiscardHandler)
+	var store = NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+	var broker = brokers.NewMockBroker(logger, "mock", brokers.MockBrokerConfig{}, nil)
+	defer broker.Close()
+	var security = brokers.Security{Name: "Si-12.25", Code: "SiZ5", ClassCode: moex.FuturesClassCode, PriceStep: 1, PriceStepCost: 1, Lever: 1}
+	var portfolio = &Portfolio{Portfolio: brokers.Portfolio{Client: "mock", Firm: "firm", Portfolio: "acc"}}
+	var signal = Signal{Name: "signal", SecurityCode: security.Code, Price: 90_000}
+
+	var strategy = NewStrategyService(logger, broker, portfolio, security, signal.Name)
+	strategy.store = store
+	strategy.initPosition(0)
+	strategy.ClosePosition(signal)
+
+	var restarted = NewStrategyService(logger, broker, portfolio, security, signal.Name)
+	restarted.store = store
+	restarted.initPosition(0)
+	if !restarted.stopped {
+		t.Fatal("strategy must stay stopped after restart")
+	}
+
+	restarted.Rebalance(signal)
+	var resumed = NewStrategyService(logger, broker, portfolio, security, signal.Name)
+	resumed.store = store
+	resumed.initPosition(0)
+	if resumed.stopped {
+		t.Error("strategy must resume after rebalance")
+	}
+}
+
+type countingBroker struct {
+	brokers.IBroker
+	positionQueries int
+}
+
+func (b *countingBroker) GetPosition(portfolio brokers.Portfolio, security brokers.Security) (float64, error) {
+	b.positionQueries += 1
+	return b.IBroker.GetPosition(portfolio, security)
+}
+
+// Позиция у брокера запрашивается, только если нужна заявка.
+func TestStrategyChecksBrokerOnlyBeforeOrder(t *testing.T) {
+	var logger = slog.New(slog.DiscardHandler)
+	var mock = brokers.NewMockBroker(logger, "mock", brokers.MockBrokerConfig{}, nil)
+	defer mock.Close()
+	var broker = &countingBroker{IBroker: mock}
+	var security = brokers.Security{Name: "Si-12.25", Code: "SiZ5", ClassCode: moex.FuturesClassCode, PriceStep: 1, PriceStepCost: 1, Lever: 1}
+	var portfolio = &Portfolio{Portfolio: brokers.Portfolio{Client: "mock", Firm: "firm", Portfolio: "acc"}}
+	portfolio.AmountAvailable.SetValue(100_000)
+	var strategy = NewStrategyService(logger, broker, portfolio, security, "signal")
+	strategy.plannedPosition.SetValue(0)
+
+	var signal = Signal{Name: "signal", SecurityCode: security.Code, Price: 90_000, Deadline: time.Now().Add(time.Hour)}
+	signal.ContractsPerAmount.SetValue(0)
+	if strategy.OnSignal(signal) || broker.positionQueries != 0 {
+		t.Fatalf("position queries = %v", broker.positionQueries)
+	}
+
+	signal.ContractsPerAmount.SetValue(1.0 / 100_000)
+	if !strategy.OnSignal(signal) || broker.positionQueries != 1 {
+		t.Fatalf("position queries = %v", broker.positionQueries)
+	}
+	if strategy.plannedPosition.Value != 1 {
+		t.Errorf("planned position = %v", strategy.plannedPosition.Value)
+	}
+}
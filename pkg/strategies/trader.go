@@ -2,23 +2,35 @@ package strategies
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"sync"
 	"time"
 
 	"github.com/ChizhovVadim/trader/pkg/brokers"
+	"github.com/ChizhovVadim/trader/pkg/moex"
 	"github.com/ChizhovVadim/trader/pkg/usercommands"
 )
 
 type Trader struct {
-	logger     *slog.Logger
-	inbox      chan any
-	Broker     *brokers.MultyBroker
-	signals    []*SignalService
-	portfolios []*PortfolioService
-	strategies []*StrategyService
+	logger          *slog.Logger
+	inbox           chan any
+	Broker          *brokers.MultyBroker
+	signals         []*SignalService
+	portfolios      []*PortfolioService
+	strategies      []*StrategyService
+	aggregators     []*PositionAggregator
+	candleHandlers  []brokers.ICandleHandler
+	rolloverDays    int
+	stateStore      StateStore
+	reconcileConfig ReconcileConfig
 }
 
+// Сколько запросов к брокеру init выполняет одновременно.
+const maxParallelQueries = 8
+
 func NewTrader(
 	logger *slog.Logger,
 ) *Trader {
@@ -30,7 +42,17 @@ func NewTrader(
 }
 
 func (app *Trader) Close() error {
-	return app.Broker.Close()
+	var errs []error
+	for _, aggregator := range app.aggregators {
+		errs = append(errs, aggregator.Close())
+	}
+	for _, handler := range app.candleHandlers {
+		if closer, ok := handler.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	errs = append(errs, app.Broker.Close())
+	return errors.Join(errs...)
 }
 
 func (app *Trader) Inbox() chan<- any {
@@ -45,15 +67,68 @@ func (app *Trader) AddStrategy(strategy *StrategyService) {
 	app.strategies = append(app.strategies, strategy)
 }
 
-// Каждый сигнал торгуем в каждом портфеле
+// Каждый сигнал торгуем в каждом портфеле.
 func (app *Trader) AddStrategiesForAllSignalPortfolioPairs() {
-	for _, signal := range app.signals {
-		for _, portfolio := range app.portfolios {
-			app.AddStrategy(NewStrategyService(app.logger, portfolio.broker, portfolio.portfolio, signal.security, signal.name))
+	app.AddStrategiesForSignalPortfolioPairs(func(signalName string, portfolio brokers.Portfolio) bool {
+		return true
+	})
+}
+
+// Торгуем сигналы в портфелях, для которых match возвращает true.
+// Если несколько сигналов торгуют один инструмент, то их стратегии в портфеле
+// работают через PositionAggregator и не мешают друг другу.
+func (app *Trader) AddStrategiesForSignalPortfolioPairs(match func(signalName string, portfolio brokers.Portfolio) bool) {
+	for _, portfolio := range app.portfolios {
+		var signalsBySecurity = make(map[string]int)
+		for _, signal := range app.signals {
+			if match(signal.name, portfolio.portfolio.Portfolio) {
+				signalsBySecurity[signal.security.Code] += 1
+			}
+		}
+		var aggregator *PositionAggregator
+		for _, signal := range app.signals {
+			if !match(signal.name, portfolio.portfolio.Portfolio) {
+				continue
+			}
+			var broker = portfolio.broker
+			if signalsBySecurity[signal.security.Code] > 1 {
+				if aggregator == nil {
+					aggregator = NewPositionAggregator(app.logger, portfolio.broker, portfolio.portfolio.Portfolio, app.inbox)
+					app.AddPositionAggregator(aggregator)
+				}
+				broker = aggregator.NewMember(signal.name)
+			}
+			app.AddStrategy(NewStrategyService(app.logger, broker, portfolio.portfolio, signal.security, signal.name))
 		}
 	}
 }
 
+func (app *Trader) AddPositionAggregator(aggregator *PositionAggregator) {
+	app.aggregators = append(app.aggregators, aggregator)
+}
+
+// Получает бары раньше сигналов.
+// Например, MockBroker исполняет заявки, выставленные на предыдущих барах.
+func (app *Trader) AddCandleHandler(handler brokers.ICandleHandler) {
+	app.candleHandlers = append(app.candleHandlers, handler)
+}
+
+// За daysBeforeExpiration дней до последнего дня торгов
+// позиции переносятся в следующий контракт.
+func (app *Trader) EnableRollover(daysBeforeExpiration int) {
+	app.rolloverDays = daysBeforeExpiration
+}
+
+// Состояние портфелей, сигналов и стратегий сохраняется между перезапусками.
+func (app *Trader) EnableStateStore(store StateStore) {
+	app.stateStore = store
+}
+
+// Политика устранения расхождений плановой позиции стратегий с позицией у брокера.
+func (app *Trader) SetReconcileConfig(config ReconcileConfig) {
+	app.reconcileConfig = config
+}
+
 func (app *Trader) AddPortfolio(portfolio *PortfolioService) {
 	app.portfolios = append(app.portfolios, portfolio)
 }
@@ -75,6 +150,10 @@ func (app *Trader) checkStatus() {
 		strategy.CheckStatus()
 	}
 	fmt.Println("Total strategies:", len(app.strategies))
+
+	for _, aggregator := range app.aggregators {
+		aggregator.CheckStatus()
+	}
 }
 
 func (app *Trader) init(ctx context.Context) error {
@@ -83,17 +162,31 @@ func (app *Trader) init(ctx context.Context) error {
 		return err
 	}
 	for _, portfolio := range app.portfolios {
-		var err = portfolio.Init()
-		if err != nil {
-			return err
-		}
+		portfolio.store = app.stateStore
+	}
+	for _, aggregator := range app.aggregators {
+		aggregator.store = app.stateStore
 	}
 	for _, strategy := range app.strategies {
-		var err = strategy.Init()
+		strategy.store = app.stateStore
+		strategy.reconcile = app.reconcileConfig
+	}
+	for _, signal := range app.signals {
+		signal.store = app.stateStore
+	}
+	for _, portfolio := range app.portfolios {
+		var err = portfolio.Init()
 		if err != nil {
 			return err
 		}
 	}
+	brokerPositions, err := app.getBrokerPositions()
+	if err != nil {
+		return err
+	}
+	for i, strategy := range app.strategies {
+		strategy.initPosition(brokerPositions[i])
+	}
 	// сигналы последние, тк они подписываются на бары
 	for _, signal := range app.signals {
 		var err = signal.Init()
@@ -105,6 +198,26 @@ func (app *Trader) init(ctx context.Context) error {
 	return nil
 }
 
+// Позиции у брокера запрашиваются одновременно, тк QuikService выполняет запросы конвейером.
+// Состояние стратегий меняется уже последовательно в init.
+func (app *Trader) getBrokerPositions() ([]float64, error) {
+	var positions = make([]float64, len(app.strategies))
+	var errs = make([]error, len(app.strategies))
+	var sem = make(chan struct{}, maxParallelQueries)
+	var wg sync.WaitGroup
+	for i, strategy := range app.strategies {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			positions[i], errs[i] = strategy.getBrokerPos()
+		}()
+	}
+	wg.Wait()
+	return positions, errors.Join(errs...)
+}
+
 func (app *Trader) Run(ctx context.Context) error {
 	if err := app.init(ctx); err != nil {
 		return err
@@ -135,6 +248,171 @@ func (app *Trader) onCandle(candle brokers.Candle) bool {
 	return orderRegistered
 }
 
+// Сначала закрываем позиции во всех стратегиях сигнала,
+// а когда все закрыты, переводим сигнал и стратегии на следующий контракт.
+func (app *Trader) checkRollover(date time.Time) bool {
+	if app.rolloverDays == 0 {
+		return false
+	}
+	var orderRegistered bool
+	for _, signal := range app.signals {
+		expiration, err := moex.ExpirationDate(signal.security.Name)
+		if err != nil {
+			// вечные фьючерсы
+			continue
+		}
+		if moex.DaysUntil(date, expiration) > app.rolloverDays {
+			continue
+		}
+		next, err := moex.NextContract(signal.security.Name)
+		if err != nil {
+			app.logger.Warn("Rollover failed",
+				"security", signal.security.Name,
+				"error", err)
+			continue
+		}
+		security, err := moex.GetSecurityInfo(next)
+		if err != nil {
+			app.logger.Warn("Rollover failed",
+				"security", signal.security.Name,
+				"error", err)
+			continue
+		}
+		var closed = true
+		for _, strategy := range app.strategies {
+			if !strategy.isSignalStrategy(signal) {
+				continue
+			}
+			if !strategy.closeForRollover(signal.lastSignal, &orderRegistered) {
+				closed = false
+			}
+		}
+		if !closed {
+			continue
+		}
+		for _, strategy := range app.strategies {
+			if strategy.isSignalStrategy(signal) {
+				strategy.rollover(security)
+			}
+		}
+		signal.rollover(security)
+	}
+	return orderRegistered
+}
+
+// Закрыть все позиции клиента (или всех клиентов, если client пустой).
+func (app *Trader) closeAll(client string) bool {
+	app.logger.Info("Close all positions",
+		"client", client)
+	var orderRegistered bool
+	for _, signalStrategy := range app.signals {
+		for _, strategy := range app.strategies {
+			if !matchClient(client, strategy.portfolio) {
+				continue
+			}
+			if strategy.ClosePosition(signalStrategy.lastSignal) {
+				orderRegistered = true
+			}
+		}
+	}
+	return orderRegistered
+}
+
+// Ребалансировка к последним сигналам без ожидания следующего бара.
+func (app *Trader) rebalance(client string) bool {
+	app.logger.Info("Rebalance",
+		"client", client)
+	var orderRegistered bool
+	for _, signalStrategy := range app.signals {
+		for _, strategy := range app.strategies {
+			if !matchClient(client, strategy.portfolio) {
+				continue
+			}
+			if strategy.Rebalance(signalStrategy.lastSignal) {
+				orderRegistered = true
+			}
+		}
+	}
+	return orderRegistered
+}
+
+// Повторно читаем лимиты, например, после ввода/вывода средств.
+func (app *Trader) initLimits(client string) {
+	for _, portfolio := range app.portfolios {
+		if !matchClient(client, portfolio.portfolio) {
+			continue
+		}
+		var err = portfolio.InitLimits()
+		if err != nil {
+			app.logger.Warn("Init portfolio failed",
+				"client", portfolio.portfolio.Portfolio.Client,
+				"portfolio", portfolio.portfolio.Portfolio.Portfolio,
+				"error", err)
+		}
+	}
+}
+
+// Сбрасывает сохраненное состояние: лимиты и позиции заново читаются у брокера,
+// базовая цена сигналов берется со следующего бара.
+func (app *Trader) resetState() {
+	app.logger.Info("Reset state")
+	if app.stateStore != nil {
+		var err = app.stateStore.Reset()
+		if err != nil {
+			app.logger.Warn("Reset state failed",
+				"error", err)
+		}
+	}
+	app.initLimits("")
+	for _, strategy := range app.strategies {
+		strategy.resetState()
+	}
+	for _, signal := range app.signals {
+		signal.resetState()
+	}
+}
+
+// Сверка позиций после восстановления соединения с брокером.
+func (app *Trader) reconcile(client string) {
+	for _, aggregator := range app.aggregators {
+		if client == "" || client == aggregator.portfolio.Client {
+			aggregator.Reconcile()
+		}
+	}
+	for _, strategy := range app.strategies {
+		if !matchClient(client, strategy.portfolio) {
+			continue
+		}
+		strategy.Reconcile()
+	}
+}
+
+// Отправляет брокеру заявки стратегий, накопленные агрегаторами.
+func (app *Trader) flushNetting() bool {
+	var orderRegistered bool
+	for _, aggregator := range app.aggregators {
+		if aggregator.Flush() {
+			orderRegistered = true
+		}
+	}
+	return orderRegistered
+}
+
+func (app *Trader) onOrder(state brokers.OrderState) {
+	for _, aggregator := range app.aggregators {
+		if aggregator.OnOrder(state) {
+			return
+		}
+	}
+	for _, strategy := range app.strategies {
+		strategy.OnOrder(state)
+	}
+}
+
+func matchClient(client string, portfolio *Portfolio) bool {
+	return client == "" || client == portfolio.Portfolio.Client
+}
+
 func (app *Trader) eventLoop(ctx context.Context) error {
 	var shouldCheckStatus = time.After(1 * time.Second)
 	for {
@@ -154,13 +432,71 @@ func (app *Trader) eventLoop(ctx context.Context) error {
 				return nil
 			case usercommands.CheckStatusUserCmd:
 				app.checkStatus()
+			case usercommands.InitLimitsUserCmd:
+				app.initLimits(msg.Client)
+			case usercommands.ResetStateUserCmd:
+				app.resetState()
+			case usercommands.RebalanceUserCmd:
+				if app.rebalance(msg.Client) {
+					if shouldCheckStatus == nil {
+						shouldCheckStatus = time.After(10 * time.Second)
+					}
+				}
+			case usercommands.CloseAllUserCmd:
+				if app.closeAll(msg.Client) {
+					if shouldCheckStatus == nil {
+						shouldCheckStatus = time.After(10 * time.Second)
+					}
+				}
+			case brokers.OrderState:
+				app.onOrder(msg)
+			case brokers.Trade:
+				app.logger.Info("Trade",
+					"client", msg.Portfolio.Client,
+					"portfolio", msg.Portfolio.Portfolio,
+					"security", msg.SecurityCode,
+					"volume", msg.Volume,
+					"price", msg.Price,
+					"orderId", msg.OrderId)
+			case brokers.ConnectionState:
+				if msg.Connected {
+					app.logger.Info("Broker connected",
+						"client", msg.Client)
+					app.reconcile(msg.Client)
+					if shouldCheckStatus == nil {
+						shouldCheckStatus = time.After(1 * time.Second)
+					}
+				} else {
+					app.logger.Warn("Broker disconnected",
+						"client", msg.Client)
+				}
+			case brokers.CandleGap:
+				app.logger.Warn("Candle gap",
+					"security", msg.SecurityCode,
+					"timeframe", msg.Interval,
+					"from", msg.From,
+					"to", msg.To,
+					"missed", msg.Missed)
 			case brokers.Candle:
-				if app.onCandle(msg) {
+				for _, handler := range app.candleHandlers {
+					handler.OnCandle(msg)
+				}
+				var orderRegistered = app.onCandle(msg)
+				if app.checkRollover(msg.DateTime) {
+					orderRegistered = true
+				}
+				if orderRegistered {
 					if shouldCheckStatus == nil {
 						shouldCheckStatus = time.After(10 * time.Second)
 					}
 				}
 			}
+			// стратегии могли выставить заявки через агрегаторы
+			if app.flushNetting() {
+				if shouldCheckStatus == nil {
+					shouldCheckStatus = time.After(10 * time.Second)
+				}
+			}
 		}
 	}
 }
@@ -0,0 +1,57 @@
+package strategies
+
+import (
+	"math"
+	"time"
+
+	"github.com/ChizhovVadim/trader/pkg/brokers"
+	"github.com/ChizhovVadim/trader/pkg/indicators"
+)
+
+const (
+	TradingDaysPerYear        = 252
+	defaultVolatilityLookback = 20
+)
+
+// Реализованная годовая волатильность инструмента по дневным доходностям.
+// Доходность дня считается по цене закрытия последнего бара дня.
+type dailyVolatility struct {
+	ind       *indicators.Volatility
+	day       time.Time
+	lastClose float64
+	ready     bool
+}
+
+// Конфигурация отклоняет lookback меньше 2, кроме 0 (по умолчанию).
+func newDailyVolatility(lookback int) *dailyVolatility {
+	if lookback < 2 {
+		lookback = defaultVolatilityLookback
+	}
+	var ind, _ = indicators.NewVolatility(lookback)
+	return &dailyVolatility{ind: ind}
+}
+
+func (v *dailyVolatility) add(candle brokers.HistoryCandle) {
+	var day = truncateDay(candle.DateTime)
+	if !v.day.IsZero() && day.After(v.day) {
+		v.ready = v.ind.Add(v.day, v.lastClose)
+	}
+	if v.day.IsZero() || day.After(v.day) {
+		v.day = day
+	}
+	v.lastClose = candle.ClosePrice
+}
+
+func (v *dailyVolatility) value() (float64, bool) {
+	if !v.ready {
+		return 0, false
+	}
+	return v.ind.Value() * math.Sqrt(TradingDaysPerYear), true
+}
+
+// Размер позиции в долях капитала при целевой волатильности.
+func applyVolatilitySize(pos float64, config SizeConfig, volatility float64) float64 {
+	pos *= config.TargetVolatility / volatility
+	pos = config.Weight * max(-config.MaxLever, min(config.MaxLever, pos))
+	return pos
+}
@@ -18,3 +18,7 @@ type RebalanceUserCmd struct {
 type CloseAllUserCmd struct {
 	Client string
 }
+
+// Сбросить сохраненное состояние робота.
+// Например, после ручных сделок в терминале.
+type ResetStateUserCmd struct{}
@@ -42,24 +42,35 @@ func parseUserCmd(commandLine string) (any, bool) {
 		return CheckStatusUserCmd{}, true
 	}
 	if commandName == "initlimits" {
-		var res = InitLimitsUserCmd{}
-		for {
-			var token = tokens.Next()
-			if token == "" {
-				break
-			}
-			if token == "client" {
-				res.Client = tokens.Next()
-			}
-		}
-		return res, true
+		return InitLimitsUserCmd{Client: parseClient(&tokens)}, true
+	}
+	if commandName == "rebalance" {
+		return RebalanceUserCmd{Client: parseClient(&tokens)}, true
+	}
+	if commandName == "resetstate" {
+		return ResetStateUserCmd{}, true
 	}
 	if commandName == "closeall" {
-		return CloseAllUserCmd{}, true
+		return CloseAllUserCmd{Client: parseClient(&tokens)}, true
 	}
 	return nil, false
 }
 
+// Необязательный параметр "client X". Пустая строка означает всех клиентов.
+func parseClient(tokens *Tokens) string {
+	var client string
+	for {
+		var token = tokens.Next()
+		if token == "" {
+			break
+		}
+		if token == "client" {
+			client = tokens.Next()
+		}
+	}
+	return client
+}
+
 type Tokens struct {
 	fields []string
 }